@@ -1,11 +1,13 @@
 package tor
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
+	"strings"
 )
 
 type torApp struct {
@@ -13,21 +15,31 @@ type torApp struct {
 	hook             *torHook
 	session          *torSessionManager
 	customHttpStatus map[int]string
+	assets           *torAssetManifest
+	resumables       map[string]*torResumableUpload
+	server           *http.Server
+	listener         net.Listener
 	// extHook *torHook
 }
 
 func (this *torApp) init() *torApp {
 	this.router = &torRouter{
-		app:         this,
-		Rules:       []*torRoutingRule{},
-		StaticRules: []*torRoutingRule{},
-		StaticDir:   make(map[string]string),
+		app:            this,
+		Rules:          []*torRoutingRule{},
+		StaticRules:    []*torRoutingRule{},
+		StaticDir:      make(map[string]string),
+		StaticFallback: make(map[string]*torStaticFallback),
 	}
 	this.hook = &torHook{app: this}
+	for _, event := range []string{HookBeforeMethodPost, HookBeforeMethodPut, HookBeforeMethodPatch, HookBeforeMethodDelete} {
+		this.hook.AddControllerHook(event, csrfHook)
+	}
 	// this.extHook = &torHook{app: this}
 	this.session = new(torSessionManager)
-	this.session.RegisterStorage(new(torDefaultSessionStorage))
+	this.session.RegisterStorage(newSessionStorage(SessionStorage))
 	this.customHttpStatus = make(map[int]string)
+	this.assets = new(torAssetManifest).init()
+	this.resumables = make(map[string]*torResumableUpload)
 	return this
 }
 
@@ -56,6 +68,21 @@ func (this *torApp) SetStaticPath(sPath, fPath string) {
 	this.router.SetStaticPath(sPath, fPath)
 }
 
+func (this *torApp) SetStaticFallback(sPath, file string, excludes ...string) {
+	this.router.SetStaticFallback(sPath, file, excludes...)
+}
+
+// RegisterResumableUpload serves resumable uploads under prefix, storing
+// them in storage. The returned value takes completion callbacks.
+func (this *torApp) RegisterResumableUpload(prefix string, storage UploadStorageInterface) *torResumableUpload {
+	prefix = strings.TrimSuffix(prefix, "/")
+	upload := (&torResumableUpload{prefix: prefix, storage: storage}).init()
+	this.resumables[prefix] = upload
+	this.router.AddRule(prefix, &torResumableController{})
+	this.router.AddRule(prefix+"/:id([0-9a-f]+)", &torResumableController{})
+	return upload
+}
+
 func (this *torApp) RegisterSessionStorage(storage SessionStorageInterface) {
 	this.session.RegisterStorage(storage)
 }
@@ -64,26 +91,77 @@ func (this *torApp) RegisterCustomHttpStatus(code int, filePath string) {
 	this.customHttpStatus[code] = filePath
 }
 
+func (this *torApp) BuildAssetManifest() error {
+	return this.assets.Build(this.router.StaticDir)
+}
+
+func (this *torApp) LoadAssetManifest(filename string) error {
+	return this.assets.Load(filename)
+}
+
+func (this *torApp) SaveAssetManifest(filename string) error {
+	return this.assets.Save(filename)
+}
+
+func (this *torApp) AssetUrl(url string) string {
+	return this.assets.Url(url)
+}
+
 func (this *torApp) Run(mode string, addr string, port int) {
+	checkCookieSecret()
+	if EnableAssetFingerprint {
+		var err error
+		if AssetManifest != "" {
+			err = this.LoadAssetManifest(AssetManifest)
+		} else {
+			err = this.BuildAssetManifest()
+		}
+		if err != nil {
+			panic("Asset manifest error: " + err.Error())
+		}
+	}
 	listenAddr := net.JoinHostPort(addr, fmt.Sprintf("%d", port))
 	var err error
 	switch mode {
-	case "http":
-		err = http.ListenAndServe(listenAddr, this.router)
 	case "fcgi":
 		l, e := net.Listen("tcp", listenAddr)
 		if e != nil {
 			panic("Fcgi listen error: " + e.Error())
 		}
+		this.listener = l
 		err = fcgi.Serve(l, this.router)
+		if this.listener == nil {
+			err = nil
+		}
 	default:
-		err = http.ListenAndServe(listenAddr, this.router)
+		this.server = &http.Server{Addr: listenAddr, Handler: this.router}
+		err = this.server.ListenAndServe()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
 	}
 	if err != nil {
 		panic("ListenAndServe error: " + err.Error())
 	}
 }
 
+// Shutdown stops the server, waiting for active requests until ctx is done,
+// and then releases the session storage.
+func (this *torApp) Shutdown(ctx context.Context) error {
+	var err error
+	if this.server != nil {
+		err = this.server.Shutdown(ctx)
+	}
+	if l := this.listener; l != nil {
+		this.listener = nil
+		l.Close()
+	}
+	if e := this.session.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 func (this *torApp) AppPath() string {
 	path, _ := os.Getwd()
 	return path
@@ -0,0 +1,131 @@
+package tor
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// torAssetManifest maps static urls to fingerprinted urls, e.g.
+// "/static/app.css" => "/static/app.3f2a1c9e.css", so that the files
+// can be served with a far future cache lifetime.
+type torAssetManifest struct {
+	lock    sync.RWMutex
+	assets  map[string]string
+	reverse map[string]string
+}
+
+func (this *torAssetManifest) init() *torAssetManifest {
+	this.assets = make(map[string]string)
+	this.reverse = make(map[string]string)
+	return this
+}
+
+func (this *torAssetManifest) set(assets map[string]string) {
+	reverse := make(map[string]string, len(assets))
+	for url, fpUrl := range assets {
+		reverse[fpUrl] = url
+	}
+	this.lock.Lock()
+	this.assets = assets
+	this.reverse = reverse
+	this.lock.Unlock()
+}
+
+// Build hashes every file under the static dirs and replaces the manifest.
+func (this *torAssetManifest) Build(staticDir map[string]string) error {
+	assets := make(map[string]string)
+	for sPath, fPath := range staticDir {
+		err := filepath.Walk(fPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(fPath, file)
+			if err != nil {
+				return err
+			}
+			hash, err := this.hashFile(file)
+			if err != nil {
+				return err
+			}
+			url := strings.TrimSuffix(sPath, "/") + "/" + filepath.ToSlash(rel)
+			assets[url] = this.fingerprint(url, hash)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	this.set(assets)
+	return nil
+}
+
+func (this *torAssetManifest) hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:8], nil
+}
+
+func (this *torAssetManifest) fingerprint(url, hash string) string {
+	ext := path.Ext(url)
+	return url[:len(url)-len(ext)] + "." + hash + ext
+}
+
+// Load reads a manifest written by Save, e.g. from a build step.
+func (this *torAssetManifest) Load(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	assets := make(map[string]string)
+	if err := json.Unmarshal(content, &assets); err != nil {
+		return err
+	}
+	this.set(assets)
+	return nil
+}
+
+func (this *torAssetManifest) Save(filename string) error {
+	this.lock.RLock()
+	content, err := json.MarshalIndent(this.assets, "", "\t")
+	this.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// Url returns the fingerprinted url, or url itself if it is not an asset.
+func (this *torAssetManifest) Url(url string) string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if fpUrl, ok := this.assets[url]; ok {
+		return fpUrl
+	}
+	return url
+}
+
+// Resolve maps a fingerprinted url back to the real static url.
+func (this *torAssetManifest) Resolve(fpUrl string) (string, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	url, ok := this.reverse[fpUrl]
+	return url, ok
+}
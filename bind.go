@@ -0,0 +1,265 @@
+package tor
+
+import (
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"mime"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	uploadFileType = reflect.TypeOf(&torUploadFile{})
+)
+
+// BindErrors holds the bind errors keyed by field name.
+type BindErrors map[string]error
+
+func (this BindErrors) Error() string {
+	fields := make([]string, 0, len(this))
+	for field := range this {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = field + ": " + this[field].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Binds the request body into dst, which must be a pointer to a struct.
+// The decoder is chosen by Content-Type: JSON and XML bodies are decoded with
+// encoding/json and encoding/xml, everything else is read from the parsed form.
+// Form fields are named by the `form` struct tag, or by the field name.
+func (this *torContext) Bind(dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("Bind destination must be a pointer to struct")
+	}
+	ctype, _, _ := mime.ParseMediaType(this.Request.Header.Get("Content-Type"))
+	switch {
+	case ctype == "application/json" || strings.HasSuffix(ctype, "+json"):
+		return this.bindJSON(dst)
+	case ctype == "application/xml" || ctype == "text/xml" || strings.HasSuffix(ctype, "+xml"):
+		return this.bindXML(dst)
+	}
+	if err := this.parseMultipart(); err != nil {
+		return err
+	}
+	binder := &torFormBinder{
+		ctx:    this,
+		form:   this.Request.Form,
+		errors: make(BindErrors),
+	}
+	binder.bindStruct(v.Elem(), "")
+	if len(binder.errors) > 0 {
+		return binder.errors
+	}
+	return nil
+}
+
+func (this *torContext) bindJSON(dst interface{}) error {
+	if this.Request.Body == nil {
+		return nil
+	}
+	err := json.NewDecoder(this.Request.Body).Decode(dst)
+	if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+		return BindErrors{e.Field: err}
+	}
+	return err
+}
+
+func (this *torContext) bindXML(dst interface{}) error {
+	if this.Request.Body == nil {
+		return nil
+	}
+	return xml.NewDecoder(this.Request.Body).Decode(dst)
+}
+
+type torFormBinder struct {
+	ctx    *torContext
+	form   url.Values
+	errors BindErrors
+}
+
+func (this *torFormBinder) bindStruct(v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name := field.Tag.Get("form")
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			this.bindStruct(fv, prefix)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		name = prefix + name
+		this.bindField(fv, field, name)
+	}
+}
+
+func (this *torFormBinder) bindField(v reflect.Value, field reflect.StructField, name string) {
+	if v.Type() == uploadFileType {
+		if file, err := this.ctx.GetUploadFile(name); err == nil {
+			v.Set(reflect.ValueOf(file))
+		}
+		return
+	}
+	if v.Kind() == reflect.Ptr {
+		if !this.hasValues(name) {
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct && v.Type() != timeType && !this.isTextUnmarshaler(v) {
+		this.bindStruct(v, name+".")
+		return
+	}
+	values, ok := this.form[name]
+	if !ok || len(values) == 0 {
+		return
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := this.setValue(slice.Index(i), field, value); err != nil {
+				this.errors[name] = err
+				return
+			}
+		}
+		v.Set(slice)
+		return
+	}
+	if err := this.setValue(v, field, values[0]); err != nil {
+		this.errors[name] = err
+	}
+}
+
+func (this *torFormBinder) hasValues(name string) bool {
+	for key := range this.form {
+		if key == name || strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+	if this.ctx.Request.MultipartForm != nil {
+		_, ok := this.ctx.Request.MultipartForm.File[name]
+		return ok
+	}
+	return false
+}
+
+func (this *torFormBinder) isTextUnmarshaler(v reflect.Value) bool {
+	if !v.CanAddr() {
+		return false
+	}
+	_, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+func (this *torFormBinder) setValue(v reflect.Value, field reflect.StructField, value string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		layout := field.Tag.Get("time_format")
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		if value == "" {
+			return nil
+		}
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(value))
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		if value == "" {
+			return nil
+		}
+		if value == "on" {
+			value = "true"
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value == "" {
+			return nil
+		}
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value == "" {
+			return nil
+		}
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if value == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		//[]byte
+		v.SetBytes([]byte(value))
+	default:
+		return errors.New("Unsupported field type: " + v.Type().String())
+	}
+	return nil
+}
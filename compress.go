@@ -0,0 +1,252 @@
+package tor
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressorFunc wraps w with an encoder for a Content-Encoding.
+type CompressorFunc func(w io.Writer, level int) (io.WriteCloser, error)
+
+var (
+	compressors = map[string]CompressorFunc{
+		"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		"deflate": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+	}
+	// server preference when the client accepts several encodings equally.
+	// br has no implementation in the standard library and is only used
+	// once one is added with RegisterCompressor.
+	compressorOrder = []string{"br", "gzip", "deflate"}
+)
+
+// RegisterCompressor adds an encoder for a Content-Encoding, e.g. "br"
+// which has no implementation in the standard library.
+func RegisterCompressor(encoding string, fn CompressorFunc) {
+	if _, ok := compressors[encoding]; !ok {
+		found := false
+		for _, e := range compressorOrder {
+			if e == encoding {
+				found = true
+			}
+		}
+		if !found {
+			compressorOrder = append(compressorOrder, encoding)
+		}
+	}
+	compressors[encoding] = fn
+}
+
+// negotiateEncoding returns the best registered encoding accepted by the
+// Accept-Encoding header, or "" for identity.
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, encoding := range compressorOrder {
+		if _, ok := compressors[encoding]; !ok {
+			continue
+		}
+		if q := acceptQuality(ranges, encoding); q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// identityAccepted reports whether the Accept-Encoding header allows an
+// uncompressed body, which "identity;q=0" or "*;q=0" forbid.
+func identityAccepted(header string) bool {
+	if header == "" {
+		return true
+	}
+	return acceptQuality(parseAccept(header), "identity") != 0
+}
+
+func isCompressibleType(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, t := range CompressTypes {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) || mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// torCompressWriter compresses the response on the fly. It buffers up to
+// CompressMinSize bytes to decide whether the body is worth compressing and
+// what its Content-Type is before any header is sent.
+type torCompressWriter struct {
+	writer      http.ResponseWriter
+	encoding    string
+	status      int
+	buf         []byte
+	encoder     io.WriteCloser
+	decided     bool
+	wroteHeader bool
+	flushed     bool
+	// identity is false when the client forbids uncompressed bodies
+	identity bool
+	// forced is set by disable, the body must then go out as is
+	forced   bool
+	rejected bool
+}
+
+func newCompressWriter(rw http.ResponseWriter, r *http.Request) *torCompressWriter {
+	rw.Header().Add("Vary", "Accept-Encoding")
+	header := r.Header.Get("Accept-Encoding")
+	return &torCompressWriter{
+		writer:   rw,
+		encoding: negotiateEncoding(header),
+		identity: identityAccepted(header),
+		status:   http.StatusOK,
+	}
+}
+
+func (this *torCompressWriter) Header() http.Header {
+	return this.writer.Header()
+}
+
+func (this *torCompressWriter) WriteHeader(code int) {
+	if this.wroteHeader || this.decided {
+		return
+	}
+	this.status = code
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent {
+		this.disable()
+	}
+}
+
+func (this *torCompressWriter) Write(p []byte) (int, error) {
+	if this.rejected {
+		return len(p), nil
+	}
+	if this.decided {
+		if this.encoder != nil {
+			return this.encoder.Write(p)
+		}
+		return this.writer.Write(p)
+	}
+	this.buf = append(this.buf, p...)
+	if this.encoding == "" || len(this.buf) >= CompressMinSize {
+		if err := this.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// disable makes the response go out uncompressed and unbuffered.
+func (this *torCompressWriter) disable() {
+	if this.decided {
+		return
+	}
+	this.encoding = ""
+	this.forced = true
+}
+
+func (this *torCompressWriter) decide() error {
+	this.decided = true
+	h := this.writer.Header()
+	if h.Get("Content-Type") == "" && len(this.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(this.buf))
+	}
+	//a flushed response is streamed, so it is compressed regardless of size,
+	//and so is any body when the client refuses identity
+	worth := (len(this.buf) >= CompressMinSize || this.flushed) && isCompressibleType(h.Get("Content-Type"))
+	if !this.identity && !this.forced && this.encoding == "" && h.Get("Content-Encoding") == "" {
+		return this.reject()
+	}
+	if this.encoding != "" && (worth || !this.identity) && h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" {
+		encoder, err := compressors[this.encoding](this.writer, CompressLevel)
+		if err != nil {
+			return err
+		}
+		this.encoder = encoder
+		h.Set("Content-Encoding", this.encoding)
+		h.Del("Content-Length")
+		//the compressed body differs from the identity one
+		if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("Etag", "W/"+etag)
+		}
+	}
+	this.wroteHeader = true
+	this.writer.WriteHeader(this.status)
+	buf := this.buf
+	this.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if this.encoder != nil {
+		_, err = this.encoder.Write(buf)
+	} else {
+		_, err = this.writer.Write(buf)
+	}
+	return err
+}
+
+// reject answers 406 when no acceptable encoding is available.
+func (this *torCompressWriter) reject() error {
+	this.rejected = true
+	this.wroteHeader = true
+	this.buf = nil
+	h := this.writer.Header()
+	h.Del("Content-Length")
+	h.Del("Etag")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	this.writer.WriteHeader(http.StatusNotAcceptable)
+	_, err := this.writer.Write([]byte("Not Acceptable"))
+	return err
+}
+
+func (this *torCompressWriter) Flush() {
+	if !this.decided {
+		this.flushed = true
+		this.decide()
+	}
+	if f, ok := this.encoder.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+	if f, ok := this.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed stream. A body smaller than CompressMinSize
+// is sent uncompressed with its exact Content-Length.
+func (this *torCompressWriter) Close() error {
+	if !this.decided {
+		if this.encoding == "" || len(this.buf) < CompressMinSize && this.identity {
+			h := this.writer.Header()
+			if h.Get("Content-Length") == "" && h.Get("Content-Encoding") == "" && len(this.buf) > 0 {
+				h.Set("Content-Length", strconv.Itoa(len(this.buf)))
+			}
+			this.encoding = ""
+		}
+		if err := this.decide(); err != nil {
+			return err
+		}
+	}
+	if this.encoder != nil {
+		return this.encoder.Close()
+	}
+	return nil
+}
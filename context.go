@@ -2,25 +2,24 @@ package tor
 
 import (
 	"bufio"
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
 	"errors"
-	"io"
-	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type torContext struct {
-	ctlr     *Controller
-	Response *torResponseWriter
-	Request  *http.Request
+	ctlr        *Controller
+	Response    *torResponseWriter
+	Request     *http.Request
+	negotiation *torNegotiation
+	stream      *torStreamWriter
+
+	multipartRead bool
+	csrfToken     []byte
+	flash         *torFlash
 }
 
 func (this *torContext) Finish() {
@@ -33,6 +32,12 @@ func (this *torContext) WriteString(content string) {
 }
 
 func (this *torContext) WriteBytes(content []byte) {
+	this.writeBytes(0, content)
+}
+
+// writeBytes writes content with the given status, or the status already
+// written by the caller when status is 0.
+func (this *torContext) writeBytes(status int, content []byte) {
 	if this.Response.Closed {
 		return
 	}
@@ -42,17 +47,22 @@ func (this *torContext) WriteBytes(content []byte) {
 		return
 	}
 
-	this.SetHeader("Content-Type", http.DetectContentType(content))
-	if EnableGzip {
-		if strings.Contains(this.Request.Header.Get("Accept-Encoding"), "gzip") {
-			this.SetHeader("Content-Encoding", "gzip")
-			buf := new(bytes.Buffer)
-			gz := gzip.NewWriter(buf)
-			gz.Write(content)
-			gz.Close()
-			content = buf.Bytes()
+	//respect a Content-Type set explicitly by SetContentType or SetHeader
+	if this.Response.Header().Get("Content-Type") == "" {
+		this.SetHeader("Content-Type", http.DetectContentType(content))
+	}
+	if EnableETag && (status == 0 || status == 200) && this.Response.status == 0 {
+		if this.Response.Header().Get("Etag") == "" {
+			this.SetHeader("Etag", bodyETag(content))
+		}
+		if this.checkNotModified() {
+			this.NotModified()
+			return
 		}
 	}
+	if status > 0 {
+		this.Response.WriteHeader(status)
+	}
 	this.Response.Write(content)
 
 	this.ctlr.app.callControllerHook("AfterOutput", hc)
@@ -63,8 +73,7 @@ func (this *torContext) WriteBytes(content []byte) {
 }
 
 func (this *torContext) Abort(status int, content string) {
-	this.Response.WriteHeader(status)
-	this.WriteString(content)
+	this.writeBytes(status, []byte(content))
 	this.Finish()
 }
 
@@ -109,17 +118,34 @@ func (this *torContext) SetContentType(ext string) {
 }
 
 //Sets a cookie -- duration is the amount of time in seconds. 0 = browser
+//The other attributes come from the app defaults, see NewCookieOptions.
 func (this *torContext) SetCookie(name string, value string, expires int64) {
-	cookie := &http.Cookie{
-		Name:  name,
-		Value: value,
-		Path:  "/",
+	opts := NewCookieOptions()
+	opts.MaxAge = int(expires)
+	this.SetCookieWithOptions(name, value, opts)
+}
+
+// Sets a cookie with explicit attributes. A nil opts uses the app defaults.
+func (this *torContext) SetCookieWithOptions(name string, value string, opts *CookieOptions) {
+	if opts == nil {
+		opts = NewCookieOptions()
 	}
-	if expires > 0 {
-		d := time.Duration(expires) * time.Second
-		cookie.Expires = time.Now().Add(d)
+	http.SetCookie(this.Response, opts.cookie(name, value))
+}
+
+// Deletes a cookie set with the default Path and Domain.
+func (this *torContext) DeleteCookie(name string) {
+	this.DeleteCookieWithOptions(name, nil)
+}
+
+// Deletes a cookie, opts must carry the Path and Domain it was set with.
+func (this *torContext) DeleteCookieWithOptions(name string, opts *CookieOptions) {
+	if opts == nil {
+		opts = NewCookieOptions()
 	}
-	http.SetCookie(this.Response, cookie)
+	o := *opts
+	o.MaxAge = -1
+	http.SetCookie(this.Response, o.cookie(name, ""))
 }
 
 func (this *torContext) GetCookie(name string) string {
@@ -130,89 +156,100 @@ func (this *torContext) GetCookie(name string) string {
 	return cookie.Value
 }
 
+// Sets a cookie whose value is encrypted and authenticated with CookieSecret.
+// It is always HttpOnly, as scripts can not read its value anyway.
 func (this *torContext) SetSecureCookie(name string, value string, expires int64) {
-	var buf bytes.Buffer
-	encoder := base64.NewEncoder(base64.StdEncoding, &buf)
-	encoder.Write([]byte(value))
-	encoder.Close()
-	vs := buf.String()
-	ts := "0"
-	if expires > 0 {
-		d := time.Duration(expires) * time.Second
-		ts = strconv.FormatInt(time.Now().Add(d).Unix(), 10)
-	}
+	opts := NewCookieOptions()
+	opts.MaxAge = int(expires)
+	opts.HttpOnly = true
+	this.SetSecureCookieWithOptions(name, value, opts)
+}
 
-	sig := util.getCookieSig(CookieSecret, name, vs, ts)
-	cookie := strings.Join([]string{vs, ts, sig}, "|")
-	this.SetCookie(name, cookie, expires)
+func (this *torContext) SetSecureCookieWithOptions(name string, value string, opts *CookieOptions) {
+	if opts == nil {
+		opts = NewCookieOptions()
+	}
+	ts := int64(0)
+	if opts.MaxAge > 0 {
+		d := time.Duration(opts.MaxAge) * time.Second
+		ts = time.Now().Add(d).Unix()
+	}
+	cookie, err := encryptCookie(name, value, ts)
+	if err != nil {
+		return
+	}
+	this.SetCookieWithOptions(name, cookie, opts)
 }
 
+// Returns the value of a cookie set by SetSecureCookie, or "" if it is
+// missing, expired or was not sealed by one of the cookie secrets.
 func (this *torContext) GetSecureCookie(name string) string {
 	value := this.GetCookie(name)
 	if value == "" {
 		return ""
 	}
-	parts := strings.SplitN(value, "|", 3)
-	if len(parts) != 3 {
-		return ""
-	}
-	val := parts[0]
-	timestamp := parts[1]
-	sig := parts[2]
-	if util.getCookieSig(CookieSecret, name, val, timestamp) != sig {
-		return ""
+	if strings.Contains(value, "|") {
+		res, _ := decodeSignedCookie(name, value)
+		return res
 	}
-	ts, _ := strconv.ParseInt(timestamp, 0, 64)
-	if ts > 0 && time.Now().Unix() > ts {
-		return ""
-	}
-	buf := bytes.NewBufferString(val)
-	encoder := base64.NewDecoder(base64.StdEncoding, buf)
-	res, _ := ioutil.ReadAll(encoder)
-	return string(res)
+	res, _ := decryptCookie(name, value)
+	return res
 }
 
 func (this *torContext) GetParam(name string) string {
+	this.parseMultipart()
 	return this.Request.Form.Get(name)
 }
 
 func (this *torContext) GetUploadFile(name string) (*torUploadFile, error) {
-	if this.Request.Method != "POST" && this.Request.Method != "PUT" {
+	files, err := this.GetUploadFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// GetUploadFiles returns every file uploaded in the field name.
+func (this *torContext) GetUploadFiles(name string) ([]*torUploadFile, error) {
+	if this.Request.Method != "POST" && this.Request.Method != "PUT" && this.Request.Method != "PATCH" {
 		return nil, errors.New("Incorrect method: " + this.Request.Method)
 	}
+	if err := this.parseMultipart(); err != nil {
+		return nil, err
+	}
 	if this.Request.MultipartForm != nil && this.Request.MultipartForm.File != nil {
 		if fhs := this.Request.MultipartForm.File[name]; len(fhs) > 0 {
-			uploadFile := &torUploadFile{
-				Filename:   fhs[0].Filename,
-				fileHeader: fhs[0],
+			files := make([]*torUploadFile, len(fhs))
+			for i, fh := range fhs {
+				files[i] = &torUploadFile{
+					Filename:    SanitizeFilename(fh.Filename),
+					RawFilename: fh.Filename,
+					Size:        fh.Size,
+					fileHeader:  fh,
+				}
 			}
-			return uploadFile, nil
+			return files, nil
 		}
 	}
 	return nil, http.ErrMissingFile
 }
 
 type torUploadFile struct {
-	Filename   string
-	fileHeader *multipart.FileHeader
+	// Filename is safe to use as a file name, see SanitizeFilename.
+	Filename    string
+	RawFilename string
+	Size        int64
+	fileHeader  *multipart.FileHeader
 }
 
+// SaveFile writes the file to savePath atomically, replacing any existing file.
 func (this *torUploadFile) SaveFile(savePath string) error {
 	file, err := this.fileHeader.Open()
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	f, err := os.OpenFile(savePath, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = io.Copy(f, file)
-	if err != nil {
-		return err
-	}
-	return nil
+	return saveFileAtomic(file, savePath)
 }
 
 func (this *torUploadFile) GetContentType() string {
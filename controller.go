@@ -1,6 +1,7 @@
 package tor
 
 import (
+	"log"
 	"net/http"
 )
 
@@ -63,10 +64,26 @@ func (this *Controller) Options() {
 }
 
 func (this *Controller) Render() {
+	if this.Context.negotiation != nil {
+		//the negotiated renderer parses the template for text/html itself
+		return
+	}
 	this.Template.Parse()
 }
 
 func (this *Controller) Output() {
+	if this.Context.stream != nil {
+		this.Context.stream.Close()
+		return
+	}
+	if n := this.Context.negotiation; n != nil {
+		err := this.Context.Negotiate(n.status, n.value, n.offers...)
+		if err != nil && err != ErrNotAcceptable {
+			log.Println("Render error:", err)
+			this.Context.Abort(500, http.StatusText(500))
+		}
+		return
+	}
 	content := this.Template.GetResult()
 	if len(content) > 0 {
 		this.Context.WriteBytes(content)
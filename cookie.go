@@ -0,0 +1,69 @@
+package tor
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type CookieOptions struct {
+	Path   string
+	Domain string
+	// MaxAge is the lifetime in seconds, 0 for a browser session cookie
+	// and negative to delete the cookie.
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+// NewCookieOptions returns the app defaults set by the Cookie* config keys.
+func NewCookieOptions() *CookieOptions {
+	return &CookieOptions{
+		Path:     CookiePath,
+		Domain:   CookieDomain,
+		Secure:   CookieSecure,
+		HttpOnly: CookieHttpOnly,
+		SameSite: parseSameSite(CookieSameSite),
+	}
+}
+
+func parseSameSite(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+func (this *CookieOptions) cookie(name, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     this.Path,
+		Domain:   this.Domain,
+		Secure:   this.Secure,
+		HttpOnly: this.HttpOnly,
+		SameSite: this.SameSite,
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	//browsers drop SameSite=None cookies that are not Secure
+	if cookie.SameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+	}
+	if this.MaxAge > 0 {
+		d := time.Duration(this.MaxAge) * time.Second
+		cookie.Expires = time.Now().Add(d)
+		cookie.MaxAge = this.MaxAge
+	} else if this.MaxAge < 0 {
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
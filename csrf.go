@@ -0,0 +1,155 @@
+package tor
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfTokenLength = 32
+	csrfSessionKey  = "_csrf_token"
+)
+
+func newCSRFToken() []byte {
+	token := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		panic("Random source error: " + err.Error())
+	}
+	return token
+}
+
+// csrfSecret returns the token of the client, stored in the session or, with
+// CSRFMode "cookie", in an encrypted cookie for the double-submit pattern.
+// A missing token is created.
+func (this *torContext) csrfSecret() []byte {
+	if token := this.storedCSRFSecret(); token != nil {
+		return token
+	}
+	token := newCSRFToken()
+	stored := base64.RawURLEncoding.EncodeToString(token)
+	if CSRFMode == "cookie" {
+		this.SetSecureCookie(CSRFCookieName, stored, 0)
+	} else {
+		this.ctlr.Session.Set(csrfSessionKey, stored)
+	}
+	this.csrfToken = token
+	return token
+}
+
+// storedCSRFSecret returns the token of the client, or nil if it has none.
+func (this *torContext) storedCSRFSecret() []byte {
+	if this.csrfToken != nil {
+		return this.csrfToken
+	}
+	var stored string
+	if CSRFMode == "cookie" {
+		stored = this.GetSecureCookie(CSRFCookieName)
+	} else {
+		stored = this.ctlr.Session.Get(csrfSessionKey)
+	}
+	token, err := base64.RawURLEncoding.DecodeString(stored)
+	if err != nil || len(token) != csrfTokenLength {
+		return nil
+	}
+	this.csrfToken = token
+	return token
+}
+
+// CSRFToken returns the token to submit with unsafe requests, in the
+// CSRFTokenName form field or the CSRFHeader header. It is masked with a
+// fresh pad on every call so it can not be recovered by compression attacks.
+func (this *torContext) CSRFToken() string {
+	token := this.csrfSecret()
+	masked := newCSRFToken()
+	masked = append(masked, token...)
+	for i := 0; i < csrfTokenLength; i++ {
+		masked[csrfTokenLength+i] ^= masked[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked)
+}
+
+// CSRFField returns a hidden form input carrying the CSRF token.
+func (this *torContext) CSRFField() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(CSRFTokenName) +
+		`" value="` + this.CSRFToken() + `">`)
+}
+
+// validCSRFToken checks submitted against the stored token, without
+// creating one, so rejected requests do not start sessions.
+func (this *torContext) validCSRFToken(submitted string) bool {
+	secret := this.storedCSRFSecret()
+	masked, err := base64.RawURLEncoding.DecodeString(submitted)
+	if secret == nil || err != nil || len(masked) != 2*csrfTokenLength {
+		return false
+	}
+	token := make([]byte, csrfTokenLength)
+	for i := range token {
+		token[i] = masked[i] ^ masked[csrfTokenLength+i]
+	}
+	return subtle.ConstantTimeCompare(token, secret) == 1
+}
+
+func csrfTrustedOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, o := range CSRFTrustedOrigins {
+		if strings.EqualFold(o, u.Host) || strings.EqualFold(o, u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfExempt(urlPath string) bool {
+	for _, prefix := range CSRFExempt {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfHook guards the unsafe methods when EnableCSRF is set. The request
+// must come from the same or a trusted origin, judged by Origin or else
+// Referer, and carry a valid token. A token in a form field makes a
+// multipart body be parsed here, so clients of StreamUploads should send
+// it in the CSRFHeader header.
+func csrfHook(hc *HookController) {
+	if !EnableCSRF {
+		return
+	}
+	ctx := hc.Context
+	r := ctx.Request
+	if csrfExempt(r.URL.Path) {
+		return
+	}
+	if CSRFCheckOrigin {
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+			if !csrfTrustedOrigin(origin, r.Host) {
+				ctx.Abort(403, "CSRF origin check failed")
+				return
+			}
+		} else if referer := r.Header.Get("Referer"); referer != "" {
+			if !csrfTrustedOrigin(referer, r.Host) {
+				ctx.Abort(403, "CSRF referer check failed")
+				return
+			}
+		}
+	}
+	submitted := r.Header.Get(CSRFHeader)
+	if submitted == "" {
+		submitted = ctx.GetParam(CSRFTokenName)
+	}
+	if !ctx.validCSRFToken(submitted) {
+		ctx.Abort(403, "CSRF token invalid")
+	}
+}
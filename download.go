@@ -0,0 +1,111 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// contentDisposition builds a Content-Disposition value with a plain ASCII
+// filename for old clients and the RFC 5987 encoded filename* parameter.
+func contentDisposition(kind, filename string) string {
+	if filename == "" {
+		return kind
+	}
+	fallback := []rune{}
+	ascii := true
+	for _, c := range filename {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			fallback = append(fallback, '_')
+			ascii = false
+		} else {
+			fallback = append(fallback, c)
+		}
+	}
+	encoded := new(strings.Builder)
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if isAttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(encoded, "%%%02X", c)
+		}
+	}
+	value := kind + `; filename="` + string(fallback) + `"`
+	if !ascii {
+		value += "; filename*=UTF-8''" + encoded.String()
+	}
+	return value
+}
+
+// isAttrChar reports whether c may appear unescaped in an RFC 5987 value.
+func isAttrChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// ServeContent sends content as a download, or inline when inline is set,
+// named filename. It answers Range and conditional requests and detects the
+// MIME type from the filename, unless Content-Type was set explicitly.
+// The body is sent as is, without sniffing or compression.
+func (this *torContext) ServeContent(content io.ReadSeeker, filename string, modtime time.Time, inline bool) {
+	if this.Response.Closed {
+		return
+	}
+	hc := this.ctlr.getHookController()
+	this.ctlr.app.callControllerHook("BeforeOutput", hc)
+	if this.Response.Finished {
+		return
+	}
+
+	kind := "attachment"
+	if inline {
+		kind = "inline"
+	}
+	this.SetHeader("Content-Disposition", contentDisposition(kind, filename))
+	this.Response.DisableCompression()
+	http.ServeContent(this.Response, this.Request, filename, modtime, content)
+
+	this.ctlr.app.callControllerHook("AfterOutput", hc)
+	if this.Response.Finished {
+		return
+	}
+	this.Response.Close()
+}
+
+// ServeFile sends the file at path like ServeContent, with an ETag derived
+// from its size and modification time. An empty filename uses the base name
+// of path. A missing file results in 404.
+func (this *torContext) ServeFile(path, filename string, inline bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			this.NotFound()
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		this.NotFound()
+		return errors.New("Can not serve a directory: " + path)
+	}
+	if filename == "" {
+		filename = filepath.Base(path)
+	}
+	if this.Response.Header().Get("Etag") == "" {
+		this.SetHeader("Etag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	}
+	this.ServeContent(f, filename, fi.ModTime(), inline)
+	return nil
+}
@@ -0,0 +1,70 @@
+package tor
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bodyETag returns a weak ETag for a rendered body.
+func bodyETag(content []byte) string {
+	return fmt.Sprintf(`W/"%x"`, sha1.Sum(content))
+}
+
+// etagMatch reports whether etag is in the If-None-Match list, using the
+// weak comparison.
+func etagMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || strings.TrimPrefix(e, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified evaluates the conditional request headers against the
+// ETag and Last-Modified response headers.
+func (this *torContext) checkNotModified() bool {
+	if this.Request.Method != "GET" && this.Request.Method != "HEAD" {
+		return false
+	}
+	h := this.Response.Header()
+	if inm := this.Request.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("Etag")
+		return etag != "" && etagMatch(inm, etag)
+	}
+	ims, err := http.ParseTime(this.Request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modtime, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modtime.After(ims)
+}
+
+// CheckNotModified declares the validators of the resource before any
+// expensive work. An empty etag or zero modtime is not declared. If the
+// client copy is still fresh it answers 304 and returns true, and the
+// controller method should return immediately.
+func (this *torContext) CheckNotModified(etag string, modtime time.Time) bool {
+	if etag != "" {
+		if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+			etag = `"` + etag + `"`
+		}
+		this.SetHeader("Etag", etag)
+	}
+	if !modtime.IsZero() {
+		this.SetHeader("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if this.checkNotModified() {
+		this.NotModified()
+		return true
+	}
+	return false
+}
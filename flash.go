@@ -0,0 +1,139 @@
+package tor
+
+import (
+	"encoding/json"
+)
+
+const flashSessionKey = "_flash"
+
+// torFlash carries messages to the next request, typically across a
+// redirect. Messages are kept in the session when the client has one and
+// in an encrypted cookie otherwise, and are cleared once read.
+type torFlash struct {
+	ctx      *torContext
+	loaded   bool
+	read     bool
+	carried  bool
+	incoming map[string][]string
+	outgoing map[string][]string
+}
+
+// Flash returns the flash messages of the request.
+func (this *torContext) Flash() *torFlash {
+	if this.flash == nil {
+		this.flash = &torFlash{
+			ctx:      this,
+			incoming: make(map[string][]string),
+			outgoing: make(map[string][]string),
+		}
+	}
+	return this.flash
+}
+
+func (this *torFlash) session() *torSession {
+	if this.ctx.ctlr == nil || this.ctx.ctlr.Session == nil {
+		return nil
+	}
+	return this.ctx.ctlr.Session
+}
+
+// load reads the messages set by the previous request and clears them,
+// without creating a session for clients that have none.
+func (this *torFlash) load() {
+	if this.loaded {
+		return
+	}
+	this.loaded = true
+	if sess := this.session(); sess != nil && sess.active() {
+		if data := sess.Get(flashSessionKey); data != "" {
+			this.merge(data)
+			sess.Delete(flashSessionKey)
+		}
+	}
+	if data := this.ctx.GetSecureCookie(FlashCookieName); data != "" {
+		this.merge(data)
+		this.ctx.DeleteCookie(FlashCookieName)
+	}
+}
+
+func (this *torFlash) merge(data string) {
+	messages := make(map[string][]string)
+	if json.Unmarshal([]byte(data), &messages) != nil {
+		return
+	}
+	for category, msgs := range messages {
+		this.incoming[category] = append(this.incoming[category], msgs...)
+	}
+}
+
+// save stores the messages for the next request, with the incoming ones
+// not read yet, so that they survive a second redirect.
+func (this *torFlash) save() {
+	messages := this.outgoing
+	this.carried = !this.read && len(this.incoming) > 0
+	if this.carried {
+		messages = make(map[string][]string)
+		for category, msgs := range this.incoming {
+			messages[category] = append(messages[category], msgs...)
+		}
+		for category, msgs := range this.outgoing {
+			messages[category] = append(messages[category], msgs...)
+		}
+	}
+	content, err := json.Marshal(messages)
+	if err != nil {
+		return
+	}
+	if sess := this.session(); sess != nil && sess.active() {
+		sess.Set(flashSessionKey, string(content))
+		return
+	}
+	this.ctx.SetSecureCookie(FlashCookieName, string(content), 0)
+}
+
+// Add keeps message in category for the next request.
+func (this *torFlash) Add(category, message string) {
+	this.load()
+	this.outgoing[category] = append(this.outgoing[category], message)
+	this.save()
+}
+
+func (this *torFlash) Success(message string) {
+	this.Add("success", message)
+}
+
+func (this *torFlash) Info(message string) {
+	this.Add("info", message)
+}
+
+func (this *torFlash) Warning(message string) {
+	this.Add("warning", message)
+}
+
+func (this *torFlash) Error(message string) {
+	this.Add("error", message)
+}
+
+// Get returns the messages of category set by the previous request.
+func (this *torFlash) Get(category string) []string {
+	this.markRead()
+	return this.incoming[category]
+}
+
+// All returns every message set by the previous request, by category.
+func (this *torFlash) All() map[string][]string {
+	this.markRead()
+	return this.incoming
+}
+
+// markRead stops carrying the incoming messages to the next request.
+func (this *torFlash) markRead() {
+	this.load()
+	if this.read {
+		return
+	}
+	this.read = true
+	if this.carried {
+		this.save()
+	}
+}
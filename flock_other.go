@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package tor
+
+import (
+	"os"
+)
+
+// lockFile is a no-op where flock is missing, e.g. windows, the locks then
+// only apply within one process.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
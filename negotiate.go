@@ -0,0 +1,245 @@
+package tor
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrNotAcceptable = errors.New("Not acceptable")
+
+// RendererFunc writes value in its media type with the given status.
+type RendererFunc func(ctx *torContext, status int, value interface{}) error
+
+// CSVMarshaler is implemented by values that can be rendered as text/csv.
+type CSVMarshaler interface {
+	MarshalCSV() ([][]string, error)
+}
+
+var (
+	renderers     = make(map[string]RendererFunc)
+	rendererOrder = []string{}
+)
+
+func init() {
+	RegisterRenderer("text/html", renderHTML)
+	RegisterRenderer("application/json", func(ctx *torContext, status int, value interface{}) error {
+		return ctx.RenderJSON(status, value)
+	})
+	RegisterRenderer("application/xml", func(ctx *torContext, status int, value interface{}) error {
+		return ctx.RenderXML(status, value)
+	})
+	RegisterRenderer("text/csv", renderCSV)
+	RegisterRenderer("text/plain", renderPlain)
+}
+
+// RegisterRenderer adds or replaces the renderer for a media type. Newly
+// registered types are offered after the existing ones.
+func RegisterRenderer(mediaType string, fn RendererFunc) {
+	if _, ok := renderers[mediaType]; !ok {
+		rendererOrder = append(rendererOrder, mediaType)
+	}
+	renderers[mediaType] = fn
+}
+
+// renderHTML executes the controller template with value as the "Data" var.
+func renderHTML(ctx *torContext, status int, value interface{}) error {
+	tpl := ctx.ctlr.Template
+	if value != nil {
+		tpl.SetVar("Data", value)
+	}
+	if tpl.tpl == nil {
+		return errors.New("No template set for text/html")
+	}
+	tpl.Parse()
+	if ctx.Response.Finished {
+		return nil
+	}
+	ctx.SetHeader("Content-Type", "text/html; charset=utf-8")
+	ctx.writeBytes(status, tpl.GetResult())
+	return nil
+}
+
+func renderCSV(ctx *torContext, status int, value interface{}) error {
+	var records [][]string
+	switch v := value.(type) {
+	case [][]string:
+		records = v
+	case CSVMarshaler:
+		var err error
+		if records, err = v.MarshalCSV(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("Value can not be rendered as text/csv")
+	}
+	buf := new(strings.Builder)
+	w := csv.NewWriter(buf)
+	w.WriteAll(records)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	ctx.SetHeader("Content-Type", "text/csv; charset=utf-8")
+	ctx.writeBytes(status, []byte(buf.String()))
+	return nil
+}
+
+func renderPlain(ctx *torContext, status int, value interface{}) error {
+	ctx.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	ctx.writeBytes(status, []byte(fmt.Sprint(value)))
+	return nil
+}
+
+type torAcceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []torAcceptRange {
+	ranges := []torAcceptRange{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		ranges = append(ranges, torAcceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the q-value of the most specific range matching
+// mediaType, or -1 if no range matches.
+func acceptQuality(ranges []torAcceptRange, mediaType string) float64 {
+	q, specificity := -1.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == mediaType:
+			s = 2
+		case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(mediaType, r.mediaType[:len(r.mediaType)-1]):
+			s = 1
+		case r.mediaType == "*/*" || r.mediaType == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// NegotiateType returns the offer preferred by the Accept header, or "" if
+// none is acceptable. Without an Accept header the first offer is returned.
+func (this *torContext) NegotiateType(offers ...string) string {
+	header := this.Request.Header.Get("Accept")
+	if header == "" {
+		if len(offers) > 0 {
+			return offers[0]
+		}
+		return ""
+	}
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// Negotiate renders value with the registered renderer preferred by the
+// Accept header, restricted to offers if given. A renderer failing before
+// the output starts passes on to the next acceptable offer. It aborts with
+// 406 and returns ErrNotAcceptable when nothing matches.
+func (this *torContext) Negotiate(status int, value interface{}, offers ...string) error {
+	if len(offers) == 0 {
+		offers = this.defaultOffers(value)
+	}
+	this.AddHeader("Vary", "Accept")
+	left := offers
+	var renderErr error
+	for {
+		mediaType := this.NegotiateType(left...)
+		fn, ok := renderers[mediaType]
+		if !ok {
+			break
+		}
+		err := fn(this, status, value)
+		if err == nil || this.Response.status != 0 {
+			return err
+		}
+		renderErr = err
+		left = withoutOffer(left, mediaType)
+	}
+	if renderErr != nil {
+		return renderErr
+	}
+	this.Abort(http.StatusNotAcceptable, "Not Acceptable. Available: "+strings.Join(offers, ", "))
+	return ErrNotAcceptable
+}
+
+func withoutOffer(offers []string, mediaType string) []string {
+	left := make([]string, 0, len(offers))
+	for _, offer := range offers {
+		if offer != mediaType {
+			left = append(left, offer)
+		}
+	}
+	return left
+}
+
+// defaultOffers returns the registered media types, without text/html when
+// the controller has no template to render it and without text/csv when
+// value is not made of records.
+func (this *torContext) defaultOffers(value interface{}) []string {
+	hasTemplate := this.ctlr != nil && this.ctlr.Template != nil && this.ctlr.Template.tpl != nil
+	offers := make([]string, 0, len(rendererOrder))
+	for _, mediaType := range rendererOrder {
+		if mediaType == "text/html" && !hasTemplate {
+			continue
+		}
+		if mediaType == "text/csv" && !isCSVValue(value) {
+			continue
+		}
+		offers = append(offers, mediaType)
+	}
+	return offers
+}
+
+func isCSVValue(value interface{}) bool {
+	switch value.(type) {
+	case [][]string, CSVMarshaler:
+		return true
+	}
+	return false
+}
+
+type torNegotiation struct {
+	status int
+	value  interface{}
+	offers []string
+}
+
+// Respond stores value to be negotiated by Controller.Output, so controller
+// methods can serve browsers and API clients alike.
+func (this *torContext) Respond(status int, value interface{}, offers ...string) {
+	this.negotiation = &torNegotiation{
+		status: status,
+		value:  value,
+		offers: offers,
+	}
+}
@@ -0,0 +1,69 @@
+package tor
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"regexp"
+)
+
+var jsonpCallbackRegexp = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$]*(\.[a-zA-Z_$][0-9a-zA-Z_$]*)*$`)
+
+func (this *torContext) marshalJSON(value interface{}) ([]byte, error) {
+	if EnablePrettyRender {
+		return json.MarshalIndent(value, "", "  ")
+	}
+	return json.Marshal(value)
+}
+
+// Writes value as JSON with the given status.
+func (this *torContext) RenderJSON(status int, value interface{}) error {
+	content, err := this.marshalJSON(value)
+	if err != nil {
+		return err
+	}
+	this.SetHeader("Content-Type", "application/json; charset=utf-8")
+	this.writeBytes(status, content)
+	return nil
+}
+
+// Writes value as XML with the given status.
+func (this *torContext) RenderXML(status int, value interface{}) error {
+	var content []byte
+	var err error
+	if EnablePrettyRender {
+		content, err = xml.MarshalIndent(value, "", "  ")
+	} else {
+		content, err = xml.Marshal(value)
+	}
+	if err != nil {
+		return err
+	}
+	this.SetHeader("Content-Type", "application/xml; charset=utf-8")
+	this.writeBytes(status, append([]byte(xml.Header), content...))
+	return nil
+}
+
+// Writes value as JSONP, wrapped in the callback named by the
+// JSONPCallbackParam request parameter. Without a callback it writes plain
+// JSON, and an invalid callback name aborts with 400.
+func (this *torContext) RenderJSONP(status int, value interface{}) error {
+	callback := this.GetParam(JSONPCallbackParam)
+	if callback == "" {
+		return this.RenderJSON(status, value)
+	}
+	if len(callback) > 128 || !jsonpCallbackRegexp.MatchString(callback) {
+		this.Abort(400, "Invalid JSONP callback")
+		return nil
+	}
+	content, err := this.marshalJSON(value)
+	if err != nil {
+		return err
+	}
+	//the leading comment guards against content sniffing attacks like Rosetta Flash
+	content = append([]byte("/**/"+callback+"("), content...)
+	content = append(content, ");"...)
+	this.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+	this.SetHeader("X-Content-Type-Options", "nosniff")
+	this.writeBytes(status, content)
+	return nil
+}
@@ -0,0 +1,475 @@
+package tor
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+var ErrUploadNotFound = errors.New("Upload not found")
+
+type UploadInfo struct {
+	Id       string
+	Length   int64
+	Offset   int64
+	Metadata map[string]string
+	Created  time.Time
+	Updated  time.Time
+}
+
+func (this *UploadInfo) Complete() bool {
+	return this.Offset == this.Length
+}
+
+// UploadStorageInterface stores the data of resumable uploads.
+type UploadStorageInterface interface {
+	Create(info *UploadInfo) error
+	Info(id string) (*UploadInfo, error)
+	// WriteChunk appends r at offset and returns the number of bytes
+	// stored, which is kept even when an error is returned.
+	WriteChunk(id string, offset int64, r io.Reader) (int64, error)
+	Open(id string) (io.ReadCloser, error)
+	Delete(id string) error
+	List() ([]string, error)
+}
+
+var resumableControllerType = reflect.TypeOf(torResumableController{})
+
+type UploadCompleteFunc func(info *UploadInfo, hc *HookController)
+
+// torResumableUpload serves the tus 1.0.0 protocol (core, creation,
+// expiration and termination) under a path prefix.
+type torResumableUpload struct {
+	prefix    string
+	storage   UploadStorageInterface
+	lock      sync.Mutex
+	busy      map[string]bool
+	callbacks []UploadCompleteFunc
+}
+
+func (this *torResumableUpload) init() *torResumableUpload {
+	this.busy = make(map[string]bool)
+	go this.gc()
+	return this
+}
+
+// OnComplete registers a function called once an upload has all its data,
+// with the hook controller of the request that finished it.
+func (this *torResumableUpload) OnComplete(fn UploadCompleteFunc) {
+	this.callbacks = append(this.callbacks, fn)
+}
+
+func (this *torResumableUpload) Info(id string) (*UploadInfo, error) {
+	return this.storage.Info(id)
+}
+
+func (this *torResumableUpload) Open(id string) (io.ReadCloser, error) {
+	return this.storage.Open(id)
+}
+
+func (this *torResumableUpload) Delete(id string) error {
+	return this.storage.Delete(id)
+}
+
+func (this *torResumableUpload) expires(info *UploadInfo) time.Time {
+	return info.Updated.Add(time.Duration(ResumableUploadExpiry) * time.Second)
+}
+
+// gc deletes the incomplete uploads not touched for ResumableUploadExpiry.
+func (this *torResumableUpload) gc() {
+	for {
+		time.Sleep(time.Minute)
+		if ResumableUploadExpiry <= 0 {
+			continue
+		}
+		ids, err := this.storage.List()
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		for _, id := range ids {
+			info, err := this.storage.Info(id)
+			if err != nil || info.Complete() || this.expires(info).After(now) {
+				continue
+			}
+			if this.acquire(id) {
+				this.storage.Delete(id)
+				this.release(id)
+			}
+		}
+	}
+}
+
+func (this *torResumableUpload) acquire(id string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.busy[id] {
+		return false
+	}
+	this.busy[id] = true
+	return true
+}
+
+func (this *torResumableUpload) release(id string) {
+	this.lock.Lock()
+	delete(this.busy, id)
+	this.lock.Unlock()
+}
+
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		value := ""
+		if len(kv) > 1 {
+			if v, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+				value = string(v)
+			}
+		}
+		metadata[kv[0]] = value
+	}
+	return metadata
+}
+
+func formatUploadMetadata(metadata map[string]string) string {
+	pairs := []string{}
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func newUploadId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("Random source error: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// torResumableController handles the requests to every resumable upload
+// prefix, so AfterInit hooks and sessions apply to uploads as well.
+type torResumableController struct {
+	Controller
+}
+
+func (this *torResumableController) upload() *torResumableUpload {
+	urlPath := this.Context.Request.URL.Path
+	for prefix, upload := range this.app.resumables {
+		if urlPath == prefix || urlPath == prefix+"/" || strings.HasPrefix(urlPath, prefix+"/") {
+			return upload
+		}
+	}
+	return nil
+}
+
+func (this *torResumableController) reply(status int) {
+	this.Context.SetHeader("Tus-Resumable", tusVersion)
+	this.Context.SetHeader("Cache-Control", "no-store")
+	this.Context.Response.WriteHeader(status)
+	this.Context.Finish()
+}
+
+func (this *torResumableController) checkVersion() bool {
+	if this.Context.Request.Header.Get("Tus-Resumable") != tusVersion {
+		this.Context.SetHeader("Tus-Version", tusVersion)
+		this.reply(412)
+		return false
+	}
+	return true
+}
+
+func (this *torResumableController) Options() {
+	this.Context.SetHeader("Tus-Version", tusVersion)
+	this.Context.SetHeader("Tus-Extension", "creation,expiration,termination")
+	if ResumableUploadMaxSize > 0 {
+		this.Context.SetHeader("Tus-Max-Size", strconv.FormatInt(ResumableUploadMaxSize, 10))
+	}
+	this.reply(204)
+}
+
+func (this *torResumableController) Post() {
+	upload := this.upload()
+	if upload == nil || this.Context.GetParam(":id") != "" {
+		this.reply(405)
+		return
+	}
+	if !this.checkVersion() {
+		return
+	}
+	length, err := strconv.ParseInt(this.Context.Request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		this.reply(400)
+		return
+	}
+	if ResumableUploadMaxSize > 0 && length > ResumableUploadMaxSize {
+		this.reply(413)
+		return
+	}
+	now := time.Now()
+	info := &UploadInfo{
+		Id:       newUploadId(),
+		Length:   length,
+		Metadata: parseUploadMetadata(this.Context.Request.Header.Get("Upload-Metadata")),
+		Created:  now,
+		Updated:  now,
+	}
+	if err := upload.storage.Create(info); err != nil {
+		this.reply(500)
+		return
+	}
+	this.Context.SetHeader("Location", upload.prefix+"/"+info.Id)
+	if ResumableUploadExpiry > 0 {
+		this.Context.SetHeader("Upload-Expires", upload.expires(info).UTC().Format(http.TimeFormat))
+	}
+	if length == 0 {
+		upload.complete(info, this.getHookController())
+	}
+	this.reply(201)
+}
+
+func (this *torResumableController) info() (*torResumableUpload, *UploadInfo) {
+	upload := this.upload()
+	if upload == nil {
+		this.reply(404)
+		return nil, nil
+	}
+	if !this.checkVersion() {
+		return nil, nil
+	}
+	info, err := upload.storage.Info(this.Context.GetParam(":id"))
+	if err != nil {
+		this.reply(404)
+		return nil, nil
+	}
+	return upload, info
+}
+
+func (this *torResumableController) Head() {
+	upload, info := this.info()
+	if info == nil {
+		return
+	}
+	this.Context.SetHeader("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	this.Context.SetHeader("Upload-Length", strconv.FormatInt(info.Length, 10))
+	if len(info.Metadata) > 0 {
+		this.Context.SetHeader("Upload-Metadata", formatUploadMetadata(info.Metadata))
+	}
+	if ResumableUploadExpiry > 0 && !info.Complete() {
+		this.Context.SetHeader("Upload-Expires", upload.expires(info).UTC().Format(http.TimeFormat))
+	}
+	this.reply(200)
+}
+
+func (this *torResumableController) Patch() {
+	upload, info := this.info()
+	if info == nil {
+		return
+	}
+	r := this.Context.Request
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		this.reply(415)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		this.reply(400)
+		return
+	}
+	if !upload.acquire(info.Id) {
+		this.reply(423)
+		return
+	}
+	defer upload.release(info.Id)
+	//reload under the lock, a concurrent request may have moved the offset
+	if info, err = upload.storage.Info(info.Id); err != nil {
+		this.reply(404)
+		return
+	}
+	if offset != info.Offset {
+		this.reply(409)
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > info.Length {
+		this.reply(413)
+		return
+	}
+	n, err := upload.storage.WriteChunk(info.Id, offset, io.LimitReader(r.Body, info.Length-offset))
+	info.Offset = offset + n
+	info.Updated = time.Now()
+	if err != nil && n == 0 {
+		this.reply(500)
+		return
+	}
+	this.Context.SetHeader("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	if info.Complete() {
+		upload.complete(info, this.getHookController())
+	} else if ResumableUploadExpiry > 0 {
+		this.Context.SetHeader("Upload-Expires", upload.expires(info).UTC().Format(http.TimeFormat))
+	}
+	this.reply(204)
+}
+
+func (this *torResumableController) Delete() {
+	upload, info := this.info()
+	if info == nil {
+		return
+	}
+	if !upload.acquire(info.Id) {
+		this.reply(423)
+		return
+	}
+	defer upload.release(info.Id)
+	if err := upload.storage.Delete(info.Id); err != nil {
+		this.reply(500)
+		return
+	}
+	this.reply(204)
+}
+
+func (this *torResumableUpload) complete(info *UploadInfo, hc *HookController) {
+	for _, fn := range this.callbacks {
+		fn(info, hc)
+	}
+}
+
+// torLocalUploadStorage keeps every upload as <id>.bin with its info in
+// <id>.info in a directory.
+type torLocalUploadStorage struct {
+	dir string
+}
+
+func NewLocalUploadStorage(dir string) *torLocalUploadStorage {
+	os.MkdirAll(dir, 0755)
+	return &torLocalUploadStorage{dir: dir}
+}
+
+// Path returns the file holding the data of the upload.
+func (this *torLocalUploadStorage) Path(id string) string {
+	return filepath.Join(this.dir, id+".bin")
+}
+
+func (this *torLocalUploadStorage) infoPath(id string) string {
+	return filepath.Join(this.dir, id+".info")
+}
+
+func (this *torLocalUploadStorage) validId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *torLocalUploadStorage) saveInfo(info *UploadInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return saveFileAtomic(strings.NewReader(string(content)), this.infoPath(info.Id))
+}
+
+func (this *torLocalUploadStorage) Create(info *UploadInfo) error {
+	f, err := os.OpenFile(this.Path(info.Id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return this.saveInfo(info)
+}
+
+func (this *torLocalUploadStorage) Info(id string) (*UploadInfo, error) {
+	if !this.validId(id) {
+		return nil, ErrUploadNotFound
+	}
+	content, err := ioutil.ReadFile(this.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	info := &UploadInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (this *torLocalUploadStorage) WriteChunk(id string, offset int64, r io.Reader) (int64, error) {
+	info, err := this.Info(id)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(this.Path(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Seek(offset, io.SeekStart)
+	if err == nil {
+		n, err = io.Copy(f, r)
+	} else {
+		n = 0
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	info.Offset = offset + n
+	info.Updated = time.Now()
+	if e := this.saveInfo(info); err == nil {
+		err = e
+	}
+	return n, err
+}
+
+func (this *torLocalUploadStorage) Open(id string) (io.ReadCloser, error) {
+	if !this.validId(id) {
+		return nil, ErrUploadNotFound
+	}
+	return os.Open(this.Path(id))
+}
+
+func (this *torLocalUploadStorage) Delete(id string) error {
+	if !this.validId(id) {
+		return ErrUploadNotFound
+	}
+	err := os.Remove(this.infoPath(id))
+	os.Remove(this.Path(id))
+	if os.IsNotExist(err) {
+		return ErrUploadNotFound
+	}
+	return err
+}
+
+func (this *torLocalUploadStorage) List() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(this.dir, "*.info"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = strings.TrimSuffix(filepath.Base(m), ".info")
+	}
+	return ids, nil
+}
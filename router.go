@@ -1,20 +1,30 @@
 package tor
 
 import (
+	"bufio"
 	"errors"
+	"net"
 	"net/http"
 	// "net/url"
 	"io/ioutil"
+	"log"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 type torResponseWriter struct {
-	app      *torApp
-	writer   http.ResponseWriter
-	Closed   bool
-	Finished bool
+	app        *torApp
+	writer     http.ResponseWriter
+	compressor *torCompressWriter
+	status     int
+	Closed     bool
+	Finished   bool
+	// beforeWrite runs once, right before the headers are sent. If it fails
+	// the response becomes a 500.
+	beforeWrite func() error
 }
 
 func (this *torResponseWriter) Header() http.Header {
@@ -25,6 +35,12 @@ func (this *torResponseWriter) Write(p []byte) (int, error) {
 	if this.Closed {
 		return 0, nil
 	}
+	if this.status == 0 {
+		if err := this.start(); err != nil {
+			return 0, err
+		}
+		this.status = http.StatusOK
+	}
 	return this.writer.Write(p)
 }
 
@@ -32,6 +48,10 @@ func (this *torResponseWriter) WriteHeader(code int) {
 	if this.Closed {
 		return
 	}
+	if this.status == 0 && this.start() != nil {
+		return
+	}
+	this.status = code
 	this.writer.WriteHeader(code)
 	if filepath, ok := app.customHttpStatus[code]; ok {
 		content, err := ioutil.ReadFile(filepath)
@@ -43,10 +63,79 @@ func (this *torResponseWriter) WriteHeader(code int) {
 	}
 }
 
+func (this *torResponseWriter) start() error {
+	if fn := this.beforeWrite; fn != nil {
+		this.beforeWrite = nil
+		if err := fn(); err != nil {
+			this.fail()
+			return err
+		}
+	}
+	return nil
+}
+
+// fail replaces the response, which must not have started, with a 500 and
+// drops the rest of the output.
+func (this *torResponseWriter) fail() {
+	this.beforeWrite = nil
+	this.Closed = false
+	http.Error(this, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	this.Finished = true
+	this.Close()
+}
+
 func (this *torResponseWriter) Close() {
 	this.Closed = true
 }
 
+// Flush sends any buffered data to the client.
+func (this *torResponseWriter) Flush() {
+	if this.Closed {
+		return
+	}
+	if f, ok := this.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. for WebSocket. The
+// session is saved first, the cookies it sets are left in Header for the
+// caller to send.
+func (this *torResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if this.status == 0 {
+		if err := this.start(); err != nil {
+			return nil, nil, err
+		}
+	}
+	rw := this.writer
+	if this.compressor != nil {
+		rw = this.compressor.writer
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if this.compressor != nil {
+		//nothing may be written to the hijacked connection on close
+		this.compressor.decided = true
+	}
+	//later session changes can not set cookies anymore
+	this.status = http.StatusSwitchingProtocols
+	return conn, brw, nil
+}
+
+// DisableCompression sends the response uncompressed. It has no effect once
+// the response has started.
+func (this *torResponseWriter) DisableCompression() {
+	if this.compressor != nil {
+		this.compressor.disable()
+	}
+}
+
 type torRoutingRule struct {
 	Pattern        string
 	Regexp         *regexp.Regexp
@@ -54,17 +143,73 @@ type torRoutingRule struct {
 	ControllerType reflect.Type
 }
 
+type torStaticFallback struct {
+	File     string
+	Excludes []string
+}
+
+func (this *torStaticFallback) Excluded(urlPath string) bool {
+	for _, exclude := range this.Excludes {
+		if strings.HasPrefix(urlPath, exclude) {
+			return true
+		}
+	}
+	return false
+}
+
 type torRouter struct {
-	app         *torApp
-	Rules       []*torRoutingRule
-	StaticRules []*torRoutingRule
-	StaticDir   map[string]string
+	app            *torApp
+	Rules          []*torRoutingRule
+	StaticRules    []*torRoutingRule
+	StaticDir      map[string]string
+	StaticFallback map[string]*torStaticFallback
 }
 
 func (this *torRouter) SetStaticPath(sPath, fPath string) {
 	this.StaticDir[sPath] = fPath
 }
 
+// SetStaticFallback makes the static path sPath serve file for every request
+// that matches neither a file in the static dir nor a controller, as needed by
+// single page applications. Paths beginning with one of excludes are left to
+// the normal NotFound handling.
+func (this *torRouter) SetStaticFallback(sPath, file string, excludes ...string) {
+	this.StaticFallback[sPath] = &torStaticFallback{
+		File:     file,
+		Excludes: excludes,
+	}
+}
+
+// findStaticDirs returns the static paths prefixing urlPath, longest first.
+func (this *torRouter) findStaticDirs(urlPath string) []string {
+	var dirs []string
+	for sPath := range this.StaticDir {
+		if strings.HasPrefix(urlPath, sPath) {
+			dirs = append(dirs, sPath)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	return dirs
+}
+
+// findStaticFallback returns the fallback of the longest static path
+// prefixing urlPath, unless it excludes urlPath.
+func (this *torRouter) findStaticFallback(urlPath string) *torStaticFallback {
+	var found *torStaticFallback
+	longest := -1
+	for sPath, fallback := range this.StaticFallback {
+		if len(sPath) > longest && strings.HasPrefix(urlPath, sPath) {
+			found, longest = fallback, len(sPath)
+		}
+	}
+	if found == nil || found.Excluded(urlPath) {
+		return nil
+	}
+	return found
+}
+
 func (this *torRouter) AddRule(pattern string, c torControllerInterface) error {
 	rule := &torRoutingRule{
 		Pattern:        "",
@@ -126,6 +271,11 @@ func (this *torRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		Closed:   false,
 		Finished: false,
 	}
+	if EnableGzip {
+		w.compressor = newCompressWriter(rw, r)
+		w.writer = w.compressor
+		defer w.compressor.Close()
+	}
 	var routingRule *torRoutingRule
 	urlPath := r.URL.Path
 	pathLen := len(urlPath)
@@ -133,12 +283,35 @@ func (this *torRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	//static file server
 	if r.Method == "GET" || r.Method == "HEAD" {
-		for sPath, fPath := range this.StaticDir {
-			if strings.HasPrefix(urlPath, sPath) {
-				file := fPath + urlPath[len(sPath):]
-				http.ServeFile(w, r, file)
-				return
+		fingerprinted := false
+		if url, ok := this.app.assets.Resolve(urlPath); ok {
+			urlPath = url
+			fingerprinted = true
+		}
+		dirs := this.findStaticDirs(urlPath)
+		hasFallback := false
+		for _, sPath := range dirs {
+			file := this.StaticDir[sPath] + urlPath[len(sPath):]
+			fi, err := os.Stat(file)
+			if _, ok := this.StaticFallback[sPath]; ok {
+				hasFallback = true
+				//leave non-file paths to the controllers and the fallback
+				if err != nil || fi.IsDir() {
+					continue
+				}
+			} else if err != nil {
+				continue
 			}
+			if fingerprinted && !fi.IsDir() {
+				//fingerprinted urls never change, so they can be cached forever
+				w.Header().Set("Cache-Control", "public, max-age=31536000")
+			}
+			http.ServeFile(w, r, file)
+			return
+		}
+		if len(dirs) > 0 && !hasFallback {
+			http.NotFound(w, r)
+			return
 		}
 	}
 
@@ -177,13 +350,26 @@ func (this *torRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if routingRule == nil {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			if fallback := this.findStaticFallback(urlPath); fallback != nil {
+				http.ServeFile(w, r, fallback.File)
+				return
+			}
+		}
 		http.NotFound(w, r)
 		return
 	}
 
-	r.ParseForm()
-	if r.Method == "POST" || r.Method == "PUT" {
-		r.ParseMultipartForm(0)
+	//multipart bodies are parsed on first use, see torContext.parseMultipart
+	//only the chunks sent to RegisterResumableUpload routes skip MaxBodySize
+	resumable := routingRule.ControllerType == resumableControllerType && r.Method == "PATCH"
+	err := limitBody(w, r, resumable)
+	if err == nil {
+		err = r.ParseForm()
+	}
+	if isTooLarge(err) {
+		http.Error(w, "Request Entity Too Large", 413)
+		return
 	}
 	ci := reflect.New(routingRule.ControllerType).Interface()
 	ctx := &torContext{
@@ -204,6 +390,21 @@ func (this *torRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		ctx:            ctx,
 		data:           nil,
 	}
+	//one write per request, before the output so that cookies can be set
+	saveSession := func() error {
+		err := sess.save()
+		if err != nil {
+			log.Println("Session save error:", err)
+		}
+		return err
+	}
+	w.beforeWrite = saveSession
+	defer func() {
+		//a failed save already turned the response into a 500
+		if sess.saveErr == nil && saveSession() != nil && w.status == 0 {
+			w.fail()
+		}
+	}()
 	util.CallMethod(ci, "Init", this.app, ctx, tpl, sess, routingRule.ControllerType.Name())
 	if w.Finished {
 		return
@@ -0,0 +1,124 @@
+package tor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCookieSecret = "foobar"
+
+// cookieSecrets returns the key ring: CookieSecret, used to encrypt, then
+// the CookieLegacySecrets still accepted while rotating keys.
+func cookieSecrets() []string {
+	secrets := []string{CookieSecret}
+	for _, secret := range CookieLegacySecrets {
+		if secret != "" && secret != CookieSecret {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+func cookieAEAD(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("tor secure cookie\x00" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptCookie seals the expiry time and value with AES-GCM under the
+// primary secret. The cookie name is authenticated too, so a value can not
+// be moved to another cookie.
+func encryptCookie(name, value string, expires int64) (string, error) {
+	aead, err := cookieAEAD(CookieSecret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	plain := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(plain, uint64(expires))
+	plain = append(plain, value...)
+	sealed := aead.Seal(nonce, nonce, plain, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func decryptCookie(name, cookie string) (string, bool) {
+	value, _, ok := openCookie(name, cookie)
+	return value, ok
+}
+
+// openCookie is decryptCookie that also returns the expiry time sealed in.
+func openCookie(name, cookie string) (string, int64, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return "", 0, false
+	}
+	for _, secret := range cookieSecrets() {
+		aead, err := cookieAEAD(secret)
+		if err != nil || len(sealed) < aead.NonceSize()+aead.Overhead()+8 {
+			return "", 0, false
+		}
+		nonce := sealed[:aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(name))
+		if err != nil {
+			continue
+		}
+		expires := int64(binary.BigEndian.Uint64(plain))
+		if expires > 0 && time.Now().Unix() > expires {
+			return "", 0, false
+		}
+		return string(plain[8:]), expires, true
+	}
+	return "", 0, false
+}
+
+// decodeSignedCookie reads the "value|timestamp|signature" cookies written
+// before encryption was introduced, so they survive an upgrade.
+func decodeSignedCookie(name, cookie string) (string, bool) {
+	parts := strings.SplitN(cookie, "|", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	val, timestamp, sig := parts[0], parts[1], parts[2]
+	valid := false
+	for _, secret := range cookieSecrets() {
+		expected := util.getCookieSig(secret, name, val, timestamp)
+		if hmac.Equal([]byte(expected), []byte(sig)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", false
+	}
+	ts, _ := strconv.ParseInt(timestamp, 0, 64)
+	if ts > 0 && time.Now().Unix() > ts {
+		return "", false
+	}
+	res, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return "", false
+	}
+	return string(res), true
+}
+
+// checkCookieSecret refuses to run in production with the default secret.
+func checkCookieSecret() {
+	if AppMode == "prod" && (CookieSecret == "" || CookieSecret == defaultCookieSecret) {
+		panic("CookieSecret must be set to a private value in prod mode")
+	}
+}
@@ -1,7 +1,15 @@
 package tor
 
 import (
-	"fmt"
+	"container/heap"
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sync"
 	"time"
 )
 
@@ -13,31 +21,117 @@ type SessionStorageInterface interface {
 	Delete(string)
 }
 
+// SessionStorageErrorer may be implemented by a storage to report the
+// errors the SessionStorageInterface methods can not return. Load returns a
+// nil map for an unknown session.
+type SessionStorageErrorer interface {
+	Load(string) (map[string]string, error)
+	Save(string, map[string]string) error
+	Remove(string) error
+}
+
+// SessionStorageExister may be implemented by a storage to tell known
+// session ids apart, including sessions without data.
+type SessionStorageExister interface {
+	Exists(string) bool
+}
+
+// NewSessionID returns a random session id of SessionIdLength bytes from
+// crypto/rand, encoded as URL-safe base64.
+func NewSessionID() string {
+	n := SessionIdLength
+	if n < 16 {
+		n = 16
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("Random source error: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newSessionStorage returns the storage named by the SessionStorage config.
+func newSessionStorage(name string) SessionStorageInterface {
+	switch name {
+	case "", "memory":
+		return new(torDefaultSessionStorage)
+	case "file":
+		return NewFileSessionStorage(SessionSavePath)
+	case "cookie":
+		return NewCookieSessionStorage()
+	case "redis":
+		return NewRedisSessionStorage(SessionRedisAddr)
+	case "sql":
+		return openSQLSessionStorage()
+	}
+	panic("Unknown session storage: " + name)
+}
+
+// torSessionContextStorage is implemented by storages keeping the data in
+// the request itself, such as the cookie storage, instead of by session id.
+type torSessionContextStorage interface {
+	load(ctx *torContext) (data map[string]string, refresh bool)
+	save(ctx *torContext, data map[string]string) error
+}
+
 type torSessionManager struct {
 	sessionStorage SessionStorageInterface
 	inited         bool
+	lock           sync.Mutex
 }
 
 func (this *torSessionManager) RegisterStorage(storage SessionStorageInterface) {
 	if storage == nil {
 		return
 	}
+	this.Close()
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	this.sessionStorage = storage
 	this.inited = false
 }
 
+// Close releases the storage if it implements io.Closer.
+func (this *torSessionManager) Close() error {
+	if c, ok := this.sessionStorage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (this *torSessionManager) checkInit() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	if !this.inited {
 		this.sessionStorage.Init(SessionTTL)
 		this.inited = true
 	}
 }
 
+// contextStorage returns the storage if it keeps the data in the request.
+func (this *torSessionManager) contextStorage() torSessionContextStorage {
+	this.checkInit()
+	cs, _ := this.sessionStorage.(torSessionContextStorage)
+	return cs
+}
+
 func (this *torSessionManager) CreateSessionID() string {
 	this.checkInit()
 	return this.sessionStorage.CreateSessionID()
 }
 
+// Exists reports whether sid is a session known to the storage.
+func (this *torSessionManager) Exists(sid string) bool {
+	this.checkInit()
+	if sid == "" {
+		return false
+	}
+	if e, ok := this.sessionStorage.(SessionStorageExister); ok {
+		return e.Exists(sid)
+	}
+	return len(this.sessionStorage.Get(sid)) > 0
+}
+
 func (this *torSessionManager) Set(sid string, data map[string]string) {
 	this.checkInit()
 	this.sessionStorage.Set(sid, data)
@@ -53,22 +147,166 @@ func (this *torSessionManager) Delete(sid string) {
 	this.sessionStorage.Delete(sid)
 }
 
+// load returns the data of sid, or nil if it is not a known session.
+func (this *torSessionManager) load(sid string) (map[string]string, error) {
+	this.checkInit()
+	if e, ok := this.sessionStorage.(SessionStorageErrorer); ok {
+		return e.Load(sid)
+	}
+	if !this.Exists(sid) {
+		return nil, nil
+	}
+	return this.sessionStorage.Get(sid), nil
+}
+
+func (this *torSessionManager) save(sid string, data map[string]string) error {
+	this.checkInit()
+	if e, ok := this.sessionStorage.(SessionStorageErrorer); ok {
+		return e.Save(sid, data)
+	}
+	this.sessionStorage.Set(sid, data)
+	return nil
+}
+
+func (this *torSessionManager) remove(sid string) error {
+	this.checkInit()
+	if e, ok := this.sessionStorage.(SessionStorageErrorer); ok {
+		return e.Remove(sid)
+	}
+	this.sessionStorage.Delete(sid)
+	return nil
+}
+
+var (
+	ErrSessionValueNotFound = errors.New("Session value not found")
+	ErrOutputSent           = errors.New("Session can not be saved after the output was sent")
+)
+
 type torSession struct {
 	ctlr           *Controller
 	sessionManager *torSessionManager
 	sessionId      string
 	ctx            *torContext
 	data           map[string]string
+	dirty          bool
+	err            error
+	saveErr        error
 }
 
+// init loads the session of the request. A client without a known session
+// gets none until something is stored, see Save.
 func (this *torSession) init() {
-	if this.sessionId == "" {
-		this.sessionId = this.sessionManager.CreateSessionID()
-		this.ctx.SetSecureCookie(SessionName, this.sessionId, 0)
+	if this.data != nil {
+		return
+	}
+	if cs := this.sessionManager.contextStorage(); cs != nil {
+		this.data, this.dirty = cs.load(this.ctx)
+		return
+	}
+	if this.sessionId != "" {
+		data, err := this.sessionManager.load(this.sessionId)
+		if err != nil {
+			//keep the id, so the stored data is not replaced on save
+			this.err = err
+		} else if data == nil {
+			//never adopt an id the storage does not know, against session fixation
+			this.sessionId = ""
+		}
+		this.data = data
 	}
 	if this.data == nil {
-		this.data = this.sessionManager.Get(this.sessionId)
+		this.data = make(map[string]string)
+	}
+}
+
+// active reports whether the client has a session, without creating one.
+func (this *torSession) active() bool {
+	this.init()
+	return this.sessionId != "" || this.sessionManager.contextStorage() != nil
+}
+
+// Err returns the error met loading the session or else by the last save,
+// if any.
+func (this *torSession) Err() error {
+	this.init()
+	if this.err != nil {
+		return this.err
 	}
+	return this.saveErr
+}
+
+// Save writes the changes of the request to the storage, creating the
+// session and its cookie on first use. It runs once when the output
+// starts and once after the controller, so calling it is only needed to
+// see the storage errors. Those two fail the response with a 500 as long
+// as it has not started, and are logged.
+func (this *torSession) Save() error {
+	if err := this.save(); err != nil {
+		return err
+	}
+	return this.err
+}
+
+// save is Save without the load error when there is nothing to write, so
+// that only lost changes fail the request.
+func (this *torSession) save() error {
+	this.saveErr = this.write()
+	return this.saveErr
+}
+
+func (this *torSession) write() error {
+	if this.data == nil || !this.dirty {
+		return nil
+	}
+	if this.err != nil {
+		return this.err
+	}
+	if cs := this.sessionManager.contextStorage(); cs != nil {
+		if err := cs.save(this.ctx, this.data); err != nil {
+			return err
+		}
+		this.dirty = false
+		return nil
+	}
+	if this.sessionId == "" {
+		if len(this.data) == 0 {
+			this.dirty = false
+			return nil
+		}
+		if this.ctx.Response.status != 0 {
+			return ErrOutputSent
+		}
+		sid := this.sessionManager.CreateSessionID()
+		if err := this.sessionManager.save(sid, this.data); err != nil {
+			return err
+		}
+		this.sessionId = sid
+		this.ctx.SetSecureCookie(SessionName, sid, 0)
+		this.dirty = false
+		return nil
+	}
+	if err := this.sessionManager.save(this.sessionId, this.data); err != nil {
+		return err
+	}
+	this.dirty = false
+	return nil
+}
+
+// Regenerate moves the session data to a new id and drops the old one.
+// Call it when the privilege level changes, e.g. right after login.
+func (this *torSession) Regenerate() error {
+	this.init()
+	this.dirty = true
+	oldId := this.sessionId
+	if oldId == "" {
+		return nil
+	}
+	this.sessionId = ""
+	if err := this.Save(); err != nil {
+		this.sessionId = oldId
+		return err
+	}
+	return this.sessionManager.remove(oldId)
 }
 
 func (this *torSession) Get(key string) string {
@@ -82,69 +320,275 @@ func (this *torSession) Get(key string) string {
 func (this *torSession) Set(key string, data string) {
 	this.init()
 	this.data[key] = data
-	this.sessionManager.Set(this.sessionId, this.data)
+	this.dirty = true
 }
 
 func (this *torSession) Delete(key string) {
 	this.init()
-	delete(this.data, key)
-	this.sessionManager.Set(this.sessionId, this.data)
+	if _, exist := this.data[key]; exist {
+		delete(this.data, key)
+		this.dirty = true
+	}
+}
+
+// GetValue decodes the value stored by SetValue under key into dst.
+func (this *torSession) GetValue(key string, dst interface{}) error {
+	this.init()
+	if this.err != nil {
+		return this.err
+	}
+	data, exist := this.data[key]
+	if !exist {
+		return ErrSessionValueNotFound
+	}
+	return json.Unmarshal([]byte(data), dst)
+}
+
+// SetValue stores any value that can be encoded as JSON under key.
+func (this *torSession) SetValue(key string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	this.Set(key, string(content))
+	return nil
 }
 
+const sessionShards = 32
+
+// torDefaultSessionStorage keeps sessions in memory, spread over shards so
+// requests for different sessions rarely contend for a lock. Every shard
+// evicts its least recently used session when SessionMaxEntries is reached
+// and keeps a heap of expiry times which the gc goroutine sleeps on.
 type torDefaultSessionStorage struct {
-	ttl   int64
-	datas map[string]torDefaultSessionStorageData
+	ttl    int64
+	shards []*torSessionShard
+	stop   chan struct{}
+	once   sync.Once
+}
+
+type torSessionShard struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*torSessionEntry
+	lru     *list.List
+	expiry  torSessionHeap
 }
 
-type torDefaultSessionStorageData struct {
+type torSessionEntry struct {
+	sid     string
 	expires int64
 	data    map[string]string
+	elem    *list.Element
+	index   int
+}
+
+// torSessionHeap orders entries by expiry time, for container/heap.
+type torSessionHeap []*torSessionEntry
+
+func (this torSessionHeap) Len() int           { return len(this) }
+func (this torSessionHeap) Less(i, j int) bool { return this[i].expires < this[j].expires }
+
+func (this torSessionHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *torSessionHeap) Push(x interface{}) {
+	e := x.(*torSessionEntry)
+	e.index = len(*this)
+	*this = append(*this, e)
+}
+
+func (this *torSessionHeap) Pop() interface{} {
+	old := *this
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*this = old[:len(old)-1]
+	e.index = -1
+	return e
 }
 
 func (this *torDefaultSessionStorage) Init(ttl int64) {
-	if this.datas != nil {
+	if this.shards != nil {
 		return
 	}
 	this.ttl = ttl
-	this.datas = make(map[string]torDefaultSessionStorageData)
+	max := 0
+	if SessionMaxEntries > 0 {
+		max = (SessionMaxEntries + sessionShards - 1) / sessionShards
+	}
+	this.shards = make([]*torSessionShard, sessionShards)
+	for i := range this.shards {
+		this.shards[i] = &torSessionShard{
+			max:     max,
+			entries: make(map[string]*torSessionEntry),
+			lru:     list.New(),
+		}
+	}
+	this.stop = make(chan struct{})
 	go this.gc()
 }
 
+// Close stops the gc goroutine.
+func (this *torDefaultSessionStorage) Close() error {
+	if this.stop != nil {
+		this.once.Do(func() { close(this.stop) })
+	}
+	return nil
+}
+
+func (this *torDefaultSessionStorage) shard(sid string) *torSessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return this.shards[h.Sum32()%sessionShards]
+}
+
+// gc sleeps until the earliest session expires, instead of polling. New
+// sessions never expire before a full ttl, so it needs no wake up.
 func (this *torDefaultSessionStorage) gc() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
-		if len(this.datas) > 0 {
-			now := time.Now().Unix()
-			for sid, data := range this.datas {
-				if data.expires <= now {
-					delete(this.datas, sid)
-				}
+		select {
+		case <-this.stop:
+			return
+		case <-timer.C:
+		}
+		now := time.Now().Unix()
+		next := now + this.ttl
+		for _, s := range this.shards {
+			if e := s.sweep(now); e > 0 && e < next {
+				next = e
 			}
 		}
-		time.Sleep(time.Second)
+		wait := time.Duration(next-now) * time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer.Reset(wait)
 	}
 }
 
+// sweep removes the expired sessions and returns the next expiry, or 0.
+func (this *torSessionShard) sweep(now int64) int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for len(this.expiry) > 0 {
+		e := this.expiry[0]
+		if e.expires > now {
+			return e.expires
+		}
+		this.remove(e)
+	}
+	return 0
+}
+
+func (this *torSessionShard) remove(e *torSessionEntry) {
+	delete(this.entries, e.sid)
+	this.lru.Remove(e.elem)
+	if e.index >= 0 {
+		heap.Remove(&this.expiry, e.index)
+	}
+}
+
+// lookup returns the live entry for sid, refreshing its TTL and LRU position.
+func (this *torSessionShard) lookup(sid string, ttl int64) *torSessionEntry {
+	e, exist := this.entries[sid]
+	if !exist {
+		return nil
+	}
+	now := time.Now().Unix()
+	if e.expires <= now {
+		this.remove(e)
+		return nil
+	}
+	e.expires = now + ttl
+	heap.Fix(&this.expiry, e.index)
+	this.lru.MoveToFront(e.elem)
+	return e
+}
+
+func copySessionData(data map[string]string) map[string]string {
+	c := make(map[string]string, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
 func (this *torDefaultSessionStorage) CreateSessionID() string {
-	t := time.Now()
-	return "SESS" + fmt.Sprintf("%d%d", t.Unix(), t.Nanosecond())
+	for {
+		sid := NewSessionID()
+		if !this.Exists(sid) {
+			return sid
+		}
+	}
+}
+
+func (this *torDefaultSessionStorage) Exists(sid string) bool {
+	s := this.shard(sid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, exist := s.entries[sid]
+	return exist && e.expires > time.Now().Unix()
 }
 
 func (this *torDefaultSessionStorage) Set(sid string, data map[string]string) {
-	d := torDefaultSessionStorageData{
+	this.Save(sid, data)
+}
+
+func (this *torDefaultSessionStorage) Save(sid string, data map[string]string) error {
+	s := this.shard(sid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.lookup(sid, this.ttl); e != nil {
+		e.data = copySessionData(data)
+		return nil
+	}
+	if s.max > 0 && len(s.entries) >= s.max {
+		s.remove(s.lru.Back().Value.(*torSessionEntry))
+	}
+	e := &torSessionEntry{
+		sid:     sid,
 		expires: time.Now().Unix() + this.ttl,
-		data:    data,
+		data:    copySessionData(data),
 	}
-	this.datas[sid] = d
+	e.elem = s.lru.PushFront(e)
+	heap.Push(&s.expiry, e)
+	s.entries[sid] = e
+	return nil
 }
 
 func (this *torDefaultSessionStorage) Get(sid string) map[string]string {
-	if data, exist := this.datas[sid]; exist {
-		data.expires = time.Now().Unix() + this.ttl
-		return data.data
+	data, _ := this.Load(sid)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+func (this *torDefaultSessionStorage) Load(sid string) (map[string]string, error) {
+	s := this.shard(sid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.lookup(sid, this.ttl); e != nil {
+		return copySessionData(e.data), nil
 	}
-	return make(map[string]string)
+	return nil, nil
 }
 
 func (this *torDefaultSessionStorage) Delete(sid string) {
-	delete(this.datas, sid)
+	this.Remove(sid)
+}
+
+func (this *torDefaultSessionStorage) Remove(sid string) error {
+	s := this.shard(sid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, exist := s.entries[sid]; exist {
+		s.remove(e)
+	}
+	return nil
 }
@@ -0,0 +1,151 @@
+package tor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// each chunk stays below the 4096 bytes browsers accept for a cookie
+const sessionCookieChunk = 3800
+
+var ErrSessionTooLarge = errors.New("Session data too large for its cookies")
+
+// torCookieSessionStorage keeps the whole session in the client, encrypted
+// like a secure cookie and split over up to SessionCookieMaxChunks cookies
+// named SessionName, SessionName_1, SessionName_2... The first one starts
+// with the number of chunks. Nothing is stored on the server, so the
+// SessionStorageInterface methods do nothing.
+type torCookieSessionStorage struct {
+	ttl int64
+}
+
+func NewCookieSessionStorage() *torCookieSessionStorage {
+	return &torCookieSessionStorage{}
+}
+
+func (this *torCookieSessionStorage) Init(ttl int64) {
+	this.ttl = ttl
+}
+
+func (this *torCookieSessionStorage) CreateSessionID() string {
+	return ""
+}
+
+func (this *torCookieSessionStorage) Set(sid string, data map[string]string) {
+}
+
+func (this *torCookieSessionStorage) Get(sid string) map[string]string {
+	return make(map[string]string)
+}
+
+func (this *torCookieSessionStorage) Delete(sid string) {
+}
+
+func sessionChunkName(i int) string {
+	if i == 0 {
+		return SessionName
+	}
+	return SessionName + "_" + strconv.Itoa(i)
+}
+
+// chunks returns the number of session cookies sent by the client.
+func (this *torCookieSessionStorage) chunks(ctx *torContext) (int, string) {
+	first := ctx.GetCookie(SessionName)
+	i := strings.IndexByte(first, '.')
+	if i < 0 {
+		return 0, ""
+	}
+	n, err := strconv.Atoi(first[:i])
+	if err != nil || n < 1 || n > SessionCookieMaxChunks {
+		return 0, ""
+	}
+	return n, first[i+1:]
+}
+
+// load returns the session data of the request, and whether it must be
+// sealed again because less than half of its lifetime is left, so that
+// sessions only ever read do not expire while in use.
+func (this *torCookieSessionStorage) load(ctx *torContext) (map[string]string, bool) {
+	data := make(map[string]string)
+	n, first := this.chunks(ctx)
+	if n == 0 {
+		return data, false
+	}
+	sealed := first
+	for i := 1; i < n; i++ {
+		chunk := ctx.GetCookie(sessionChunkName(i))
+		if chunk == "" {
+			return data, false
+		}
+		sealed += chunk
+	}
+	content, expires, ok := openCookie(SessionName, sealed)
+	if !ok || json.Unmarshal([]byte(content), &data) != nil || data == nil {
+		return make(map[string]string), false
+	}
+	return data, len(data) > 0 && expires-time.Now().Unix() < this.ttl/2
+}
+
+// save replaces the session cookies of the response with data. It must run
+// before the output starts, as the cookies are response headers.
+func (this *torCookieSessionStorage) save(ctx *torContext, data map[string]string) error {
+	if ctx.Response.status != 0 {
+		return ErrOutputSent
+	}
+	var chunks []string
+	if len(data) > 0 {
+		content, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		sealed, err := encryptCookie(SessionName, string(content), time.Now().Unix()+this.ttl)
+		if err != nil {
+			return err
+		}
+		for len(sealed) > sessionCookieChunk {
+			chunks = append(chunks, sealed[:sessionCookieChunk])
+			sealed = sealed[sessionCookieChunk:]
+		}
+		chunks = append(chunks, sealed)
+		if len(chunks) > SessionCookieMaxChunks {
+			return ErrSessionTooLarge
+		}
+		chunks[0] = strconv.Itoa(len(chunks)) + "." + chunks[0]
+	}
+	this.dropCookies(ctx.Response.Header())
+	opts := NewCookieOptions()
+	opts.HttpOnly = true
+	for i, chunk := range chunks {
+		ctx.SetCookieWithOptions(sessionChunkName(i), chunk, opts)
+	}
+	sent, _ := this.chunks(ctx)
+	for i := len(chunks); i < sent; i++ {
+		ctx.DeleteCookieWithOptions(sessionChunkName(i), opts)
+	}
+	return nil
+}
+
+// dropCookies removes the session cookies set earlier in the same request,
+// so that every save replaces them instead of adding more headers.
+func (this *torCookieSessionStorage) dropCookies(h http.Header) {
+	kept := h["Set-Cookie"][:0]
+	for _, line := range h["Set-Cookie"] {
+		name := line
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			name = line[:i]
+		}
+		if name == SessionName || strings.HasPrefix(name, SessionName+"_") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		h.Del("Set-Cookie")
+	} else {
+		h["Set-Cookie"] = kept
+	}
+}
@@ -0,0 +1,253 @@
+package tor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionFilePrefix = "sess_"
+	sessionFileLocks  = 16
+)
+
+// torFileSessionStorage keeps one JSON file per session in a directory, so
+// sessions survive restarts and are shared by the workers of a host. The
+// modification time of a file is its last access. Accesses are serialized
+// per lock stripe, with flock between processes where available.
+type torFileSessionStorage struct {
+	dir   string
+	ttl   int64
+	locks [sessionFileLocks]sync.RWMutex
+	err   error
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// NewFileSessionStorage returns a storage saving sessions in dir, which is
+// created if missing.
+func NewFileSessionStorage(dir string) *torFileSessionStorage {
+	return &torFileSessionStorage{dir: dir}
+}
+
+func (this *torFileSessionStorage) Init(ttl int64) {
+	if this.stop != nil {
+		return
+	}
+	this.ttl = ttl
+	if err := os.MkdirAll(this.dir, 0700); err != nil {
+		//kept for Load, Save and Remove, as Init runs within a request
+		this.err = errors.New("Session storage error: " + err.Error())
+		return
+	}
+	this.stop = make(chan struct{})
+	go this.gc()
+}
+
+// Close stops the expiry sweep.
+func (this *torFileSessionStorage) Close() error {
+	if this.stop != nil {
+		this.once.Do(func() { close(this.stop) })
+	}
+	return nil
+}
+
+// path returns the file of sid, or "" if sid can not be a session id.
+func (this *torFileSessionStorage) path(sid string) string {
+	if sid == "" || len(sid) > 128 {
+		return ""
+	}
+	for _, c := range sid {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return filepath.Join(this.dir, sessionFilePrefix+sid)
+}
+
+// lock takes the stripe of sid in this process and in every other process
+// using the same directory. The returned function releases it.
+func (this *torFileSessionStorage) lock(sid string, exclusive bool) func() {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	n := h.Sum32() % sessionFileLocks
+	mu := &this.locks[n]
+	if exclusive {
+		mu.Lock()
+	} else {
+		mu.RLock()
+	}
+	f, err := os.OpenFile(filepath.Join(this.dir, ".lock-"+strconv.Itoa(int(n))), os.O_RDWR|os.O_CREATE, 0600)
+	if err == nil {
+		if lockFile(f, exclusive) != nil {
+			f.Close()
+			f = nil
+		}
+	} else {
+		f = nil
+	}
+	return func() {
+		if f != nil {
+			unlockFile(f)
+			f.Close()
+		}
+		if exclusive {
+			mu.Unlock()
+		} else {
+			mu.RUnlock()
+		}
+	}
+}
+
+func (this *torFileSessionStorage) expired(fi os.FileInfo, now time.Time) bool {
+	return fi.ModTime().Add(time.Duration(this.ttl) * time.Second).Before(now)
+}
+
+// gc removes the expired session files every minute, or every ttl if shorter.
+func (this *torFileSessionStorage) gc() {
+	interval := time.Minute
+	if ttl := time.Duration(this.ttl) * time.Second; ttl > 0 && ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+		infos, err := ioutil.ReadDir(this.dir)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		for _, fi := range infos {
+			if !strings.HasPrefix(fi.Name(), sessionFilePrefix) || !this.expired(fi, now) {
+				continue
+			}
+			sid := strings.TrimPrefix(fi.Name(), sessionFilePrefix)
+			unlock := this.lock(sid, true)
+			//the session may have been used since the directory was read
+			if fi, err := os.Stat(this.path(sid)); err == nil && this.expired(fi, now) {
+				os.Remove(this.path(sid))
+			}
+			unlock()
+		}
+	}
+}
+
+func (this *torFileSessionStorage) CreateSessionID() string {
+	for {
+		sid := NewSessionID()
+		//only a taken id is retried, other errors are reported by Save
+		if _, err := os.Stat(this.path(sid)); err != nil {
+			return sid
+		}
+	}
+}
+
+func (this *torFileSessionStorage) Exists(sid string) bool {
+	path := this.path(sid)
+	if path == "" {
+		return false
+	}
+	unlock := this.lock(sid, false)
+	defer unlock()
+	fi, err := os.Stat(path)
+	return err == nil && !this.expired(fi, time.Now())
+}
+
+func (this *torFileSessionStorage) Set(sid string, data map[string]string) {
+	this.Save(sid, data)
+}
+
+func (this *torFileSessionStorage) Save(sid string, data map[string]string) error {
+	if this.err != nil {
+		return this.err
+	}
+	path := this.path(sid)
+	if path == "" {
+		return errors.New("Invalid session id")
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	unlock := this.lock(sid, true)
+	defer unlock()
+	return writeFileAtomic(bytes.NewReader(content), path, 0600)
+}
+
+func (this *torFileSessionStorage) Get(sid string) map[string]string {
+	data, _ := this.Load(sid)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+// Load reads the session and touches its file to refresh the TTL.
+func (this *torFileSessionStorage) Load(sid string) (map[string]string, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	path := this.path(sid)
+	if path == "" {
+		return nil, nil
+	}
+	unlock := this.lock(sid, false)
+	defer unlock()
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if this.expired(fi, now) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	os.Chtimes(path, now, now)
+	return data, nil
+}
+
+func (this *torFileSessionStorage) Delete(sid string) {
+	this.Remove(sid)
+}
+
+func (this *torFileSessionStorage) Remove(sid string) error {
+	if this.err != nil {
+		return this.err
+	}
+	path := this.path(sid)
+	if path == "" {
+		return nil
+	}
+	unlock := this.lock(sid, true)
+	defer unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
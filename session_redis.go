@@ -0,0 +1,317 @@
+package tor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// torRedisSessionStorage keeps the sessions in Redis as JSON strings under
+// Prefix+sid, expiring through EXPIRE, so any instance can serve any user.
+// It speaks RESP over a small pool of connections.
+type torRedisSessionStorage struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	PoolSize int
+	Timeout  time.Duration
+
+	ttl    int64
+	idle   chan *torRedisConn
+	lock   sync.Mutex
+	closed bool
+}
+
+// NewRedisSessionStorage returns a storage for the Redis server at addr,
+// configured from the SessionRedis* config keys.
+func NewRedisSessionStorage(addr string) *torRedisSessionStorage {
+	return &torRedisSessionStorage{
+		Addr:     addr,
+		Password: SessionRedisPassword,
+		DB:       SessionRedisDB,
+		Prefix:   SessionRedisPrefix,
+		PoolSize: SessionRedisPoolSize,
+		Timeout:  time.Duration(SessionRedisTimeout) * time.Second,
+	}
+}
+
+func (this *torRedisSessionStorage) Init(ttl int64) {
+	this.ttl = ttl
+	if this.PoolSize <= 0 {
+		this.PoolSize = 1
+	}
+	if this.idle == nil {
+		this.idle = make(chan *torRedisConn, this.PoolSize)
+	}
+}
+
+// Close closes the idle connections, the busy ones are closed when they
+// are given back.
+func (this *torRedisSessionStorage) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed || this.idle == nil {
+		return nil
+	}
+	this.closed = true
+	for {
+		select {
+		case conn := <-this.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (this *torRedisSessionStorage) get() (*torRedisConn, error) {
+	select {
+	case conn := <-this.idle:
+		return conn, nil
+	default:
+	}
+	return dialRedis(this.Addr, this.Password, this.DB, this.Timeout)
+}
+
+// put gives conn back to the pool, or closes it after an error or when the
+// pool is full.
+func (this *torRedisSessionStorage) put(conn *torRedisConn, err error) {
+	if err != nil {
+		if _, ok := err.(torRedisError); !ok {
+			conn.Close()
+			return
+		}
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case this.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// do sends the commands in one round trip and returns their replies.
+func (this *torRedisSessionStorage) do(cmds ...[]string) ([]interface{}, error) {
+	conn, err := this.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.pipeline(this.Timeout, cmds...)
+	this.put(conn, err)
+	return replies, err
+}
+
+func (this *torRedisSessionStorage) key(sid string) string {
+	return this.Prefix + sid
+}
+
+func (this *torRedisSessionStorage) CreateSessionID() string {
+	for {
+		sid := NewSessionID()
+		replies, err := this.do([]string{"EXISTS", this.key(sid)})
+		if err != nil || replies[0] == int64(0) {
+			return sid
+		}
+	}
+}
+
+func (this *torRedisSessionStorage) Exists(sid string) bool {
+	replies, err := this.do([]string{"EXISTS", this.key(sid)})
+	return err == nil && replies[0] == int64(1)
+}
+
+func (this *torRedisSessionStorage) Set(sid string, data map[string]string) {
+	this.Save(sid, data)
+}
+
+func (this *torRedisSessionStorage) Save(sid string, data map[string]string) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = this.do([]string{"SET", this.key(sid), string(content), "EX", strconv.FormatInt(this.ttl, 10)})
+	return err
+}
+
+func (this *torRedisSessionStorage) Get(sid string) map[string]string {
+	data, _ := this.Load(sid)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+// Load reads the session and refreshes its TTL in the same round trip.
+func (this *torRedisSessionStorage) Load(sid string) (map[string]string, error) {
+	replies, err := this.do(
+		[]string{"GET", this.key(sid)},
+		[]string{"EXPIRE", this.key(sid), strconv.FormatInt(this.ttl, 10)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := replies[0].([]byte)
+	if !ok {
+		return nil, nil
+	}
+	data := make(map[string]string)
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	return data, nil
+}
+
+func (this *torRedisSessionStorage) Delete(sid string) {
+	this.Remove(sid)
+}
+
+func (this *torRedisSessionStorage) Remove(sid string) error {
+	_, err := this.do([]string{"DEL", this.key(sid)})
+	return err
+}
+
+// torRedisError is an error reply, which leaves the connection usable.
+type torRedisError string
+
+func (this torRedisError) Error() string {
+	return "Redis error: " + string(this)
+}
+
+type torRedisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialRedis(addr, password string, db int, timeout time.Duration) (*torRedisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &torRedisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	var cmds [][]string
+	if password != "" {
+		cmds = append(cmds, []string{"AUTH", password})
+	}
+	if db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(db)})
+	}
+	if len(cmds) > 0 {
+		if _, err := c.pipeline(timeout, cmds...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (this *torRedisConn) Close() error {
+	return this.conn.Close()
+}
+
+// pipeline writes the commands as RESP arrays of bulk strings and reads a
+// reply for each. The first error reply is returned after all replies are
+// read, so the connection stays in sync.
+func (this *torRedisConn) pipeline(timeout time.Duration, cmds ...[]string) ([]interface{}, error) {
+	if timeout > 0 {
+		this.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	for _, args := range cmds {
+		this.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			this.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+			this.w.WriteString(arg)
+			this.w.WriteString("\r\n")
+		}
+	}
+	if err := this.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := this.readReply()
+		if err != nil {
+			if _, ok := err.(torRedisError); !ok {
+				return nil, err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+func (this *torRedisConn) readLine() (string, error) {
+	line, err := this.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("Redis protocol error: bad line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply returns a string, int64, []byte, nil or []interface{} reply.
+func (this *torRedisConn) readReply() (interface{}, error) {
+	line, err := this.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, torRedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(this.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := this.readReply()
+			if err != nil {
+				if _, ok := err.(torRedisError); !ok {
+					return nil, err
+				}
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, errors.New("Redis protocol error: unknown reply " + strconv.Quote(line[:1]))
+}
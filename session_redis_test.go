@@ -0,0 +1,311 @@
+package tor
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a RESP server knowing the few commands the session storage
+// sends. Every connection must AUTH first when password is set.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	lock     sync.Mutex
+	data     map[string]string
+	ttls     map[string]int64
+	dbs      map[string]int
+	cmds     []string
+	accepted int
+	hang     bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeRedis{
+		ln:       ln,
+		password: password,
+		data:     make(map[string]string),
+		ttls:     make(map[string]int64),
+		dbs:      make(map[string]int),
+	}
+	go srv.serve()
+	t.Cleanup(func() { ln.Close() })
+	return srv
+}
+
+func (this *fakeRedis) serve() {
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.accepted++
+		this.lock.Unlock()
+		go this.handle(conn)
+	}
+}
+
+func (this *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := this.password == ""
+	db := 0
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.cmds = append(this.cmds, strings.Join(args, " "))
+		hang := this.hang
+		this.lock.Unlock()
+		if hang {
+			continue
+		}
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if args[1] != this.password {
+				reply = "-WRONGPASS invalid password\r\n"
+				break
+			}
+			authed = true
+			reply = "+OK\r\n"
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			reply = "+OK\r\n"
+		default:
+			reply = this.exec(db, args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (this *fakeRedis) exec(db int, args []string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	switch args[0] {
+	case "SET":
+		this.data[args[1]] = args[2]
+		this.ttls[args[1]], _ = strconv.ParseInt(args[4], 10, 64)
+		this.dbs[args[1]] = db
+		return "+OK\r\n"
+	case "GET":
+		value, ok := this.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case "EXPIRE":
+		if _, ok := this.data[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		this.ttls[args[1]], _ = strconv.ParseInt(args[2], 10, 64)
+		return ":1\r\n"
+	case "EXISTS":
+		if _, ok := this.data[args[1]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "DEL":
+		delete(this.data, args[1])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (this *fakeRedis) commands() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]string(nil), this.cmds...)
+}
+
+func (this *fakeRedis) connections() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.accepted
+}
+
+func newTestRedisStorage(srv *fakeRedis, password string, db int) *torRedisSessionStorage {
+	storage := &torRedisSessionStorage{
+		Addr:     srv.ln.Addr().String(),
+		Password: password,
+		DB:       db,
+		Prefix:   "test:",
+		PoolSize: 2,
+		Timeout:  time.Second,
+	}
+	storage.Init(60)
+	return storage
+}
+
+func TestRedisSessionStorageAuthSelect(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+	storage := newTestRedisStorage(srv, "secret", 3)
+	defer storage.Close()
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	cmds := srv.commands()
+	if len(cmds) != 3 || cmds[0] != "AUTH secret" || cmds[1] != "SELECT 3" {
+		t.Fatalf("commands = %q", cmds)
+	}
+	srv.lock.Lock()
+	db := srv.dbs["test:sid"]
+	srv.lock.Unlock()
+	if db != 3 {
+		t.Errorf("saved in db %d, want 3", db)
+	}
+
+	bad := newTestRedisStorage(srv, "wrong", 0)
+	defer bad.Close()
+	if _, err := bad.Load("sid"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Load with a wrong password = %v", err)
+	}
+}
+
+func TestRedisSessionStorageLoadRefreshesExpiry(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	storage := newTestRedisStorage(srv, "", 0)
+	defer storage.Close()
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.lock.Lock()
+	srv.ttls["test:sid"] = 5
+	srv.lock.Unlock()
+
+	data, err := storage.Load("sid")
+	if err != nil || data["a"] != "1" {
+		t.Fatalf("Load = %v, %v", data, err)
+	}
+	srv.lock.Lock()
+	ttl := srv.ttls["test:sid"]
+	srv.lock.Unlock()
+	if ttl != 60 {
+		t.Errorf("ttl after Load = %d, want 60", ttl)
+	}
+	cmds := srv.commands()
+	if got := cmds[len(cmds)-1]; got != "EXPIRE test:sid 60" {
+		t.Errorf("last command = %q", got)
+	}
+
+	if data, err := storage.Load("missing"); data != nil || err != nil {
+		t.Errorf("Load of a missing session = %v, %v", data, err)
+	}
+	if !storage.Exists("sid") || storage.Exists("missing") {
+		t.Error("Exists does not match the stored sessions")
+	}
+	if err := storage.Remove("sid"); err != nil || storage.Exists("sid") {
+		t.Errorf("Remove = %v, session still exists: %v", err, storage.Exists("sid"))
+	}
+}
+
+func TestRedisConnPipeline(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	conn, err := dialRedis(srv.ln.Addr().String(), "", 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	replies, err := conn.pipeline(time.Second,
+		[]string{"SET", "k", "v", "EX", "10"},
+		[]string{"NOPE"},
+		[]string{"GET", "k"},
+		[]string{"EXISTS", "k"},
+	)
+	if _, ok := err.(torRedisError); !ok {
+		t.Fatalf("pipeline error = %v, want the error reply", err)
+	}
+	if replies[0] != "OK" || replies[1] != nil || string(replies[2].([]byte)) != "v" || replies[3] != int64(1) {
+		t.Errorf("replies = %q", replies)
+	}
+	// every reply was read, so the next command gets its own reply
+	replies, err = conn.pipeline(time.Second, []string{"GET", "missing"})
+	if err != nil || replies[0] != nil {
+		t.Errorf("GET after pipeline = %q, %v", replies, err)
+	}
+}
+
+func TestRedisSessionStorageErrorReplyKeepsConn(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	storage := newTestRedisStorage(srv, "", 0)
+	defer storage.Close()
+
+	if _, err := storage.do([]string{"NOPE"}); err == nil {
+		t.Fatal("unknown command did not fail")
+	}
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1 reused after an error reply", n)
+	}
+}
+
+func TestRedisSessionStorageTimeout(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	storage := newTestRedisStorage(srv, "", 0)
+	storage.Timeout = 50 * time.Millisecond
+	defer storage.Close()
+
+	srv.lock.Lock()
+	srv.hang = true
+	srv.lock.Unlock()
+	start := time.Now()
+	_, err := storage.Load("sid")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Load = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Load took %v", d)
+	}
+
+	srv.lock.Lock()
+	srv.hang = false
+	srv.lock.Unlock()
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.connections(); n != 2 {
+		t.Errorf("connections = %d, want the timed out one replaced", n)
+	}
+}
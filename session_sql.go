@@ -0,0 +1,299 @@
+package tor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLDialect builds the statements that differ between databases.
+type SQLDialect interface {
+	// Placeholder returns the bind parameter n, counting from 1.
+	Placeholder(n int) string
+	CreateTableSQL(table string) []string
+	// UpsertSQL inserts or replaces the (id, data, expires) row.
+	UpsertSQL(table string) string
+}
+
+var sqlDialects = map[string]SQLDialect{
+	"mysql":    mysqlDialect{},
+	"postgres": postgresDialect{},
+	"sqlite":   sqliteDialect{},
+}
+
+// RegisterSQLDialect adds or replaces a dialect, selectable by name with
+// the SessionSQLDialect config key.
+func RegisterSQLDialect(name string, dialect SQLDialect) {
+	sqlDialects[name] = dialect
+}
+
+// sqlDialectFor returns the dialect named name, or guessed from driver.
+func sqlDialectFor(name, driver string) (SQLDialect, error) {
+	if name == "" {
+		switch driver {
+		case "postgres", "pgx":
+			name = "postgres"
+		case "sqlite3", "sqlite":
+			name = "sqlite"
+		default:
+			name = "mysql"
+		}
+	}
+	if dialect, ok := sqlDialects[name]; ok {
+		return dialect, nil
+	}
+	return nil, errors.New("Unknown sql dialect: " + name)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (mysqlDialect) CreateTableSQL(table string) []string {
+	return []string{"CREATE TABLE IF NOT EXISTS " + table + " (id VARCHAR(128) NOT NULL PRIMARY KEY, " +
+		"data MEDIUMTEXT NOT NULL, expires BIGINT NOT NULL, INDEX " + table + "_expires (expires))"}
+}
+
+func (mysqlDialect) UpsertSQL(table string) string {
+	return "INSERT INTO " + table + " (id, data, expires) VALUES (?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE data = VALUES(data), expires = VALUES(expires)"
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresDialect) CreateTableSQL(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (id VARCHAR(128) PRIMARY KEY, data TEXT NOT NULL, expires BIGINT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expires ON " + table + " (expires)",
+	}
+}
+
+func (postgresDialect) UpsertSQL(table string) string {
+	return "INSERT INTO " + table + " (id, data, expires) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires = excluded.expires"
+}
+
+type sqliteDialect struct {
+	postgresDialect
+}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (sqliteDialect) UpsertSQL(table string) string {
+	return "INSERT INTO " + table + " (id, data, expires) VALUES (?, ?, ?) " +
+		"ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires = excluded.expires"
+}
+
+// torSQLSessionStorage keeps the sessions as JSON in a table, one row per
+// session with its expiry time as unix seconds. Expired rows are ignored
+// on read and deleted periodically.
+type torSQLSessionStorage struct {
+	db      *sql.DB
+	dialect SQLDialect
+	table   string
+	ttl     int64
+	driver  string
+	dsn     string
+	ownDB   bool
+	err     error
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewSQLSessionStorage returns a storage using the SessionSQLTable table of
+// db, which is created if missing.
+func NewSQLSessionStorage(db *sql.DB, dialect SQLDialect) *torSQLSessionStorage {
+	return &torSQLSessionStorage{
+		db:      db,
+		dialect: dialect,
+		table:   SessionSQLTable,
+	}
+}
+
+// openSQLSessionStorage returns a storage for the database of the
+// SessionSQL* config keys. It is only opened by Init, on the first use of a
+// session, as the driver imported by the application registers itself after
+// this package is initialized.
+func openSQLSessionStorage() *torSQLSessionStorage {
+	return &torSQLSessionStorage{
+		table:  SessionSQLTable,
+		driver: SessionSQLDriver,
+		dsn:    SessionSQLDSN,
+		ownDB:  true,
+	}
+}
+
+// Init opens the database and creates the table. It runs within the first
+// request using a session, so an error is kept and returned by Load, Save
+// and Remove instead.
+func (this *torSQLSessionStorage) Init(ttl int64) {
+	if this.stop != nil {
+		return
+	}
+	this.ttl = ttl
+	if this.db == nil {
+		db, err := sql.Open(this.driver, this.dsn)
+		if err != nil {
+			this.err = errors.New("Session storage error: " + err.Error())
+			return
+		}
+		this.db = db
+	}
+	if this.dialect == nil {
+		dialect, err := sqlDialectFor(SessionSQLDialect, this.driver)
+		if err != nil {
+			this.err = errors.New("Session storage error: " + err.Error())
+			return
+		}
+		this.dialect = dialect
+	}
+	for _, query := range this.dialect.CreateTableSQL(this.table) {
+		if _, err := this.db.Exec(query); err != nil {
+			this.err = errors.New("Session storage error: " + err.Error())
+			return
+		}
+	}
+	this.stop = make(chan struct{})
+	go this.gc()
+}
+
+// Close stops the cleanup, and closes the database if it was opened from
+// the config.
+func (this *torSQLSessionStorage) Close() error {
+	var err error
+	this.once.Do(func() {
+		if this.stop != nil {
+			close(this.stop)
+		}
+		if this.ownDB && this.db != nil {
+			err = this.db.Close()
+		}
+	})
+	return err
+}
+
+// query replaces the ? of q with the placeholders of the dialect.
+func (this *torSQLSessionStorage) query(q string) string {
+	parts := strings.Split(q, "?")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = this.dialect.Placeholder(i) + parts[i]
+	}
+	return strings.Join(parts, "")
+}
+
+// gc deletes the expired rows every minute, or every ttl if shorter.
+func (this *torSQLSessionStorage) gc() {
+	interval := time.Minute
+	if ttl := time.Duration(this.ttl) * time.Second; ttl > 0 && ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+		this.cleanup()
+	}
+}
+
+// cleanup deletes the expired rows.
+func (this *torSQLSessionStorage) cleanup() error {
+	_, err := this.db.Exec(this.query("DELETE FROM "+this.table+" WHERE expires <= ?"), time.Now().Unix())
+	return err
+}
+
+func (this *torSQLSessionStorage) CreateSessionID() string {
+	for {
+		sid := NewSessionID()
+		if !this.Exists(sid) {
+			return sid
+		}
+	}
+}
+
+func (this *torSQLSessionStorage) Exists(sid string) bool {
+	if this.err != nil {
+		return false
+	}
+	var one int
+	err := this.db.QueryRow(this.query("SELECT 1 FROM "+this.table+" WHERE id = ? AND expires > ?"),
+		sid, time.Now().Unix()).Scan(&one)
+	return err == nil
+}
+
+func (this *torSQLSessionStorage) Set(sid string, data map[string]string) {
+	this.Save(sid, data)
+}
+
+func (this *torSQLSessionStorage) Save(sid string, data map[string]string) error {
+	if this.err != nil {
+		return this.err
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = this.db.Exec(this.dialect.UpsertSQL(this.table), sid, string(content), time.Now().Unix()+this.ttl)
+	return err
+}
+
+func (this *torSQLSessionStorage) Get(sid string) map[string]string {
+	data, _ := this.Load(sid)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+// Load reads the session and pushes back its expiry.
+func (this *torSQLSessionStorage) Load(sid string) (map[string]string, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	now := time.Now().Unix()
+	var content string
+	err := this.db.QueryRow(this.query("SELECT data FROM "+this.table+" WHERE id = ? AND expires > ?"),
+		sid, now).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	if err := json.Unmarshal([]byte(content), &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	_, err = this.db.Exec(this.query("UPDATE "+this.table+" SET expires = ? WHERE id = ?"), now+this.ttl, sid)
+	return data, err
+}
+
+func (this *torSQLSessionStorage) Delete(sid string) {
+	this.Remove(sid)
+}
+
+func (this *torSQLSessionStorage) Remove(sid string) error {
+	if this.err != nil {
+		return this.err
+	}
+	_, err := this.db.Exec(this.query("DELETE FROM "+this.table+" WHERE id = ?"), sid)
+	return err
+}
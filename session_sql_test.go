@@ -0,0 +1,302 @@
+package tor
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a database/sql driver understanding the statements of
+// the postgres dialect on the session table. Databases are shared by DSN.
+type fakeSQLDriver struct {
+	lock sync.Mutex
+	dbs  map[string]*fakeSQLDB
+}
+
+type fakeSQLRow struct {
+	data    string
+	expires int64
+}
+
+type fakeSQLDB struct {
+	lock sync.Mutex
+	rows map[string]fakeSQLRow
+}
+
+var (
+	fakeSQL         = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+	fakeSQLLateOnce sync.Once
+)
+
+func init() {
+	sql.Register("torfake", fakeSQL)
+}
+
+func (this *fakeSQLDriver) db(dsn string) *fakeSQLDB {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	db, ok := this.dbs[dsn]
+	if !ok {
+		db = &fakeSQLDB{rows: make(map[string]fakeSQLRow)}
+		this.dbs[dsn] = db
+	}
+	return db
+}
+
+func (this *fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	return &fakeSQLConn{db: this.db(dsn)}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (this *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: this.db, query: query}, nil
+}
+
+func (this *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (this *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (this *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (this *fakeSQLStmt) NumInput() int {
+	return strings.Count(this.query, "$")
+}
+
+func (this *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := this.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	q := this.query
+	switch {
+	case strings.HasPrefix(q, "CREATE "):
+	case strings.HasPrefix(q, "INSERT INTO tor_sessions (id, data, expires) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE"):
+		db.rows[args[0].(string)] = fakeSQLRow{args[1].(string), args[2].(int64)}
+	case q == "UPDATE tor_sessions SET expires = $1 WHERE id = $2":
+		if row, ok := db.rows[args[1].(string)]; ok {
+			row.expires = args[0].(int64)
+			db.rows[args[1].(string)] = row
+		}
+	case q == "DELETE FROM tor_sessions WHERE id = $1":
+		delete(db.rows, args[0].(string))
+	case q == "DELETE FROM tor_sessions WHERE expires <= $1":
+		for id, row := range db.rows {
+			if row.expires <= args[0].(int64) {
+				delete(db.rows, id)
+			}
+		}
+	default:
+		return nil, errors.New("unexpected statement: " + q)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (this *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := this.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var column string
+	switch this.query {
+	case "SELECT 1 FROM tor_sessions WHERE id = $1 AND expires > $2":
+		column = "1"
+	case "SELECT data FROM tor_sessions WHERE id = $1 AND expires > $2":
+		column = "data"
+	default:
+		return nil, errors.New("unexpected query: " + this.query)
+	}
+	rows := &fakeSQLRows{column: column}
+	if row, ok := db.rows[args[0].(string)]; ok && row.expires > args[1].(int64) {
+		if column == "1" {
+			rows.values = []driver.Value{int64(1)}
+		} else {
+			rows.values = []driver.Value{row.data}
+		}
+	}
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	column string
+	values []driver.Value
+}
+
+func (this *fakeSQLRows) Columns() []string {
+	return []string{this.column}
+}
+
+func (this *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (this *fakeSQLRows) Next(dest []driver.Value) error {
+	if this.values == nil {
+		return io.EOF
+	}
+	copy(dest, this.values)
+	this.values = nil
+	return nil
+}
+
+func (this *fakeSQLDB) row(id string) (fakeSQLRow, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	row, ok := this.rows[id]
+	return row, ok
+}
+
+func (this *fakeSQLDB) setExpires(id string, expires int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	row := this.rows[id]
+	row.expires = expires
+	this.rows[id] = row
+}
+
+func newTestSQLStorage(t *testing.T) (*torSQLSessionStorage, *fakeSQLDB) {
+	dsn := t.Name()
+	db, err := sql.Open("torfake", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	storage := NewSQLSessionStorage(db, postgresDialect{})
+	storage.Init(60)
+	t.Cleanup(func() { storage.Close() })
+	return storage, fakeSQL.db(dsn)
+}
+
+func TestSQLSessionStorageQuery(t *testing.T) {
+	storage := &torSQLSessionStorage{dialect: postgresDialect{}}
+	if q := storage.query("SELECT 1 FROM t WHERE id = ? AND expires > ?"); q != "SELECT 1 FROM t WHERE id = $1 AND expires > $2" {
+		t.Errorf("postgres query = %q", q)
+	}
+	storage.dialect = mysqlDialect{}
+	if q := storage.query("DELETE FROM t WHERE id = ?"); q != "DELETE FROM t WHERE id = ?" {
+		t.Errorf("mysql query = %q", q)
+	}
+}
+
+func TestSQLSessionStorageUpsert(t *testing.T) {
+	storage, db := newTestSQLStorage(t)
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Save("sid", map[string]string{"a": "2", "b": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	row, ok := db.row("sid")
+	if !ok || row.data != `{"a":"2","b":"3"}` {
+		t.Fatalf("row = %+v, %v", row, ok)
+	}
+	if d := row.expires - time.Now().Unix(); d < 59 || d > 60 {
+		t.Errorf("row expires in %ds, want 60", d)
+	}
+
+	data, err := storage.Load("sid")
+	if err != nil || data["a"] != "2" || data["b"] != "3" {
+		t.Errorf("Load = %v, %v", data, err)
+	}
+	if !storage.Exists("sid") {
+		t.Error("saved session does not exist")
+	}
+	if err := storage.Remove("sid"); err != nil || storage.Exists("sid") {
+		t.Errorf("Remove = %v, session still exists: %v", err, storage.Exists("sid"))
+	}
+}
+
+func TestSQLSessionStorageExpiry(t *testing.T) {
+	storage, db := newTestSQLStorage(t)
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// a load pushes the expiry back
+	db.setExpires("sid", time.Now().Unix()+5)
+	if _, err := storage.Load("sid"); err != nil {
+		t.Fatal(err)
+	}
+	if row, _ := db.row("sid"); row.expires-time.Now().Unix() < 59 {
+		t.Errorf("expiry not refreshed by Load: %d", row.expires)
+	}
+
+	db.setExpires("sid", time.Now().Unix()-1)
+	if data, err := storage.Load("sid"); data != nil || err != nil {
+		t.Errorf("Load of an expired session = %v, %v", data, err)
+	}
+	if storage.Exists("sid") {
+		t.Error("expired session exists")
+	}
+}
+
+func TestSQLSessionStorageCleanup(t *testing.T) {
+	storage, db := newTestSQLStorage(t)
+
+	storage.Save("old", map[string]string{"a": "1"})
+	storage.Save("new", map[string]string{"a": "1"})
+	db.setExpires("old", time.Now().Unix()-1)
+	if err := storage.cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.row("old"); ok {
+		t.Error("expired row not deleted")
+	}
+	if _, ok := db.row("new"); !ok {
+		t.Error("live row deleted")
+	}
+}
+
+func TestSQLSessionStorageOpensOnInit(t *testing.T) {
+	driverName, dsn, dialect := SessionSQLDriver, SessionSQLDSN, SessionSQLDialect
+	defer func() {
+		SessionSQLDriver, SessionSQLDSN, SessionSQLDialect = driverName, dsn, dialect
+	}()
+	SessionSQLDriver, SessionSQLDSN, SessionSQLDialect = "torfake_late", t.Name(), "postgres"
+
+	// the driver of the application registers after this package's init
+	storage := openSQLSessionStorage()
+	fakeSQLLateOnce.Do(func() { sql.Register("torfake_late", fakeSQL) })
+	storage.Init(60)
+	defer storage.Close()
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fakeSQL.db(t.Name()).row("sid"); !ok {
+		t.Error("session not saved in the lazily opened database")
+	}
+}
+
+func TestSQLSessionStorageSetupError(t *testing.T) {
+	storage := &torSQLSessionStorage{table: SessionSQLTable, driver: "torfake_missing", ownDB: true}
+	storage.Init(60)
+	defer storage.Close()
+
+	if err := storage.Save("sid", map[string]string{"a": "1"}); err == nil {
+		t.Error("Save without a database did not fail")
+	}
+	if _, err := storage.Load("sid"); err == nil {
+		t.Error("Load without a database did not fail")
+	}
+	if storage.Exists("sid") {
+		t.Error("session exists without a database")
+	}
+}
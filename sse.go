@@ -0,0 +1,127 @@
+package tor
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SSEEvent struct {
+	Id    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// torSSE is a Server-Sent Events channel on top of a response stream.
+type torSSE struct {
+	ctx         *torContext
+	stream      *torStreamWriter
+	lock        sync.Mutex
+	LastEventId string
+}
+
+// SSE starts a text/event-stream response. Compression and proxy buffering
+// are disabled so every event reaches the client as soon as it is sent.
+// LastEventId holds the id a reconnecting client resumes from.
+func (this *torContext) SSE() *torSSE {
+	h := this.Response.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	this.Response.DisableCompression()
+	sse := &torSSE{
+		ctx:         this,
+		stream:      this.StreamWriter(),
+		LastEventId: this.Request.Header.Get("Last-Event-ID"),
+	}
+	if sse.LastEventId == "" {
+		sse.LastEventId = this.Request.URL.Query().Get("lastEventId")
+	}
+	this.Response.WriteHeader(200)
+	sse.stream.Flush()
+	return sse
+}
+
+func (this *torSSE) write(s string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, err := this.stream.WriteString(s); err != nil {
+		return err
+	}
+	this.stream.Flush()
+	return nil
+}
+
+func (this *torSSE) Send(event *SSEEvent) error {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	buf := new(strings.Builder)
+	if event.Id != "" {
+		buf.WriteString("id: " + clean.Replace(event.Id) + "\n")
+	}
+	if event.Event != "" {
+		buf.WriteString("event: " + clean.Replace(event.Event) + "\n")
+	}
+	if event.Retry > 0 {
+		buf.WriteString("retry: " + strconv.FormatInt(int64(event.Retry/time.Millisecond), 10) + "\n")
+	}
+	//clients end lines at \r\n, \n and a lone \r alike
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(event.Data)
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	return this.write(buf.String())
+}
+
+func (this *torSSE) SendData(event, data string) error {
+	return this.Send(&SSEEvent{Event: event, Data: data})
+}
+
+// Comment sends a comment line, which clients ignore. It keeps idle
+// connections open through proxies.
+func (this *torSSE) Comment(comment string) error {
+	return this.write(": " + strings.NewReplacer("\r", " ", "\n", " ").Replace(comment) + "\n\n")
+}
+
+// Done is closed when the client goes away.
+func (this *torSSE) Done() <-chan struct{} {
+	return this.ctx.Request.Context().Done()
+}
+
+// Run sends the events from the channel, with a heartbeat comment every
+// SSEHeartbeat seconds, until the channel is closed or the client goes away.
+func (this *torSSE) Run(events <-chan *SSEEvent) {
+	defer this.Close()
+	var heartbeat <-chan time.Time
+	if SSEHeartbeat > 0 {
+		ticker := time.NewTicker(time.Duration(SSEHeartbeat) * time.Second)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-this.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if this.Send(event) != nil {
+				return
+			}
+		case <-heartbeat:
+			if this.Comment("heartbeat") != nil {
+				return
+			}
+		}
+	}
+}
+
+func (this *torSSE) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.stream.Close()
+}
@@ -0,0 +1,92 @@
+package tor
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrStreamClosed = errors.New("Stream closed")
+
+// torStreamWriter writes the response body progressively. BeforeOutput hooks
+// run when the stream is opened and AfterOutput hooks when it is closed.
+type torStreamWriter struct {
+	ctx    *torContext
+	hc     *HookController
+	closed bool
+}
+
+func (this *torStreamWriter) Write(p []byte) (int, error) {
+	if this.closed || this.ctx.Response.Closed {
+		return 0, ErrStreamClosed
+	}
+	return this.ctx.Response.Write(p)
+}
+
+func (this *torStreamWriter) WriteString(s string) (int, error) {
+	return this.Write([]byte(s))
+}
+
+// Flush sends the data written so far to the client.
+func (this *torStreamWriter) Flush() {
+	if this.closed {
+		return
+	}
+	this.ctx.Response.Flush()
+}
+
+func (this *torStreamWriter) Close() {
+	if this.closed {
+		return
+	}
+	this.closed = true
+	if this.ctx.Response.Closed {
+		return
+	}
+	this.ctx.ctlr.app.callControllerHook("AfterOutput", this.hc)
+	if this.ctx.Response.Finished {
+		return
+	}
+	this.ctx.Response.Close()
+}
+
+// StreamWriter opens the response for streaming and returns its writer.
+// The stream is closed by Stream or Controller.Output, or by calling Close.
+func (this *torContext) StreamWriter() *torStreamWriter {
+	if this.stream != nil {
+		return this.stream
+	}
+	this.stream = &torStreamWriter{
+		ctx: this,
+		hc:  this.ctlr.getHookController(),
+	}
+	if this.Response.Closed {
+		this.stream.closed = true
+		return this.stream
+	}
+	this.ctlr.app.callControllerHook("BeforeOutput", this.stream.hc)
+	if this.Response.Finished {
+		this.stream.closed = true
+	}
+	return this.stream
+}
+
+// Stream calls step until it returns false, flushing after every call, and
+// then closes the stream. It stops early when the client goes away.
+func (this *torContext) Stream(step func(w io.Writer) bool) {
+	w := this.StreamWriter()
+	done := this.Request.Context().Done()
+	for !w.closed && !this.Response.Closed {
+		select {
+		case <-done:
+			w.Close()
+			return
+		default:
+		}
+		more := step(w)
+		w.Flush()
+		if !more {
+			break
+		}
+	}
+	w.Close()
+}
@@ -9,6 +9,12 @@ var tplFuncMap template.FuncMap
 
 func init() {
 	tplFuncMap = make(template.FuncMap)
+	tplFuncMap["asset"] = func(url string) string {
+		return app.AssetUrl(url)
+	}
+	//placeholders, bound to the request in torTemplate.Parse
+	tplFuncMap["csrf_token"] = func() string { return "" }
+	tplFuncMap["csrf_field"] = func() template.HTML { return "" }
 }
 
 func AddTemplateFunc(name string, tplFunc interface{}) {
@@ -34,7 +40,7 @@ func (this *torTemplate) GetVar(name string) interface{} {
 }
 
 func (this *torTemplate) SetTemplateString(str string) bool {
-	this.tpl = template.New("")
+	this.tpl = template.New("").Funcs(tplFuncMap)
 	this.tpl.Parse(str)
 	return true
 }
@@ -72,6 +78,10 @@ func (this *torTemplate) Parse() bool {
 		return false
 	}
 
+	if _, ok := this.tplVars["Flash"]; !ok {
+		this.SetVar("Flash", this.ctlr.Context.Flash().All())
+	}
+
 	hc := this.ctlr.getHookController()
 	this.ctlr.app.callControllerHook("BeforeRender", hc)
 	if this.ctlr.Context.Response.Finished {
@@ -80,6 +90,7 @@ func (this *torTemplate) Parse() bool {
 
 	this.tplResult = &torTemplateResult{data: []byte{}}
 	this.tpl.Funcs(tplFuncMap)
+	this.tpl.Funcs(this.requestFuncs())
 	err := this.tpl.Execute(this.tplResult, this.tplVars)
 	if err != nil {
 		return false
@@ -89,6 +100,16 @@ func (this *torTemplate) Parse() bool {
 	return true
 }
 
+// requestFuncs returns the template funcs bound to the current request.
+func (this *torTemplate) requestFuncs() template.FuncMap {
+	ctx := this.ctlr.Context
+	return template.FuncMap{
+		"csrf_token": ctx.CSRFToken,
+		"csrf_field": ctx.CSRFField,
+		"asset":      this.ctlr.app.AssetUrl,
+	}
+}
+
 func (this *torTemplate) GetResult() []byte {
 	if this.tplResult == nil {
 		return []byte{}
@@ -1,7 +1,9 @@
 package tor
 
 import (
+	"context"
 	"os"
+	"strings"
 )
 
 var (
@@ -14,11 +16,74 @@ var (
 	RunMode      string = "http"
 	EnableDaemon bool   = false
 	EnableStats  bool   = true
-	CookieSecret string = "foobar"
+	CookieSecret string = defaultCookieSecret
 	SessionName  string = "torSESSID"
 	SessionTTL   int64  = 60 * 15
 	EnablePprof  bool   = true
 	EnableGzip   bool   = true
+
+	SessionIdLength        int    = 32
+	SessionMaxEntries      int    = 100000
+	SessionStorage         string = "memory"
+	SessionSavePath        string = "sessions"
+	SessionCookieMaxChunks int    = 3
+
+	SessionRedisAddr     string = "127.0.0.1:6379"
+	SessionRedisPassword string = ""
+	SessionRedisDB       int    = 0
+	SessionRedisPrefix   string = "tor:session:"
+	SessionRedisPoolSize int    = 10
+	SessionRedisTimeout  int    = 5
+
+	SessionSQLDriver  string = "mysql"
+	SessionSQLDSN     string = ""
+	SessionSQLDialect string = ""
+	SessionSQLTable   string = "tor_sessions"
+
+	CompressMinSize int      = 1024
+	CompressLevel   int      = -1
+	CompressTypes   []string = []string{"text/", "application/json", "application/javascript",
+		"application/xml", "image/svg+xml"}
+
+	MaxBodySize     int64 = 10 << 20
+	MaxUploadSize   int64 = 32 << 20
+	UploadMaxMemory int64 = 1 << 20
+
+	ResumableUploadExpiry  int   = 60 * 60 * 24
+	ResumableUploadMaxSize int64 = 0
+
+	EnableETag bool = false
+
+	SSEHeartbeat int = 15
+
+	WebSocketMaxMessageSize int64    = 1 << 20
+	WebSocketPingInterval   int      = 30
+	WebSocketWriteTimeout   int      = 10
+	WebSocketOrigins        []string = []string{}
+
+	AppMode             string   = "dev"
+	CookieLegacySecrets []string = []string{}
+	CookiePath          string   = "/"
+	CookieDomain        string   = ""
+	CookieSecure        bool     = false
+	CookieHttpOnly      bool     = false
+	CookieSameSite      string   = "lax"
+	FlashCookieName     string   = "torFLASH"
+
+	EnableCSRF         bool     = false
+	CSRFMode           string   = "session"
+	CSRFTokenName      string   = "_csrf"
+	CSRFHeader         string   = "X-CSRF-Token"
+	CSRFCookieName     string   = "torCSRF"
+	CSRFCheckOrigin    bool     = true
+	CSRFTrustedOrigins []string = []string{}
+	CSRFExempt         []string = []string{}
+
+	EnablePrettyRender bool   = false
+	JSONPCallbackParam string = "callback"
+
+	EnableAssetFingerprint bool   = false
+	AssetManifest          string = ""
 )
 
 func init() {
@@ -59,6 +124,14 @@ func SetStaticPath(sPath, fPath string) {
 	app.SetStaticPath(sPath, fPath)
 }
 
+func SetStaticFallback(sPath, file string, excludes ...string) {
+	app.SetStaticFallback(sPath, file, excludes...)
+}
+
+func RegisterResumableUpload(prefix string, storage UploadStorageInterface) *torResumableUpload {
+	return app.RegisterResumableUpload(prefix, storage)
+}
+
 func RegisterSessionStorage(storage SessionStorageInterface) {
 	app.RegisterSessionStorage(storage)
 }
@@ -67,6 +140,27 @@ func RegisterCustomHttpStatus(code int, filePath string) {
 	app.RegisterCustomHttpStatus(code, filePath)
 }
 
+func BuildAssetManifest() error {
+	return app.BuildAssetManifest()
+}
+
+func LoadAssetManifest(filename string) error {
+	return app.LoadAssetManifest(filename)
+}
+
+func SaveAssetManifest(filename string) error {
+	return app.SaveAssetManifest(filename)
+}
+
+func AssetUrl(url string) string {
+	return app.AssetUrl(url)
+}
+
+// Shutdown gracefully stops the server started by Run.
+func Shutdown(ctx context.Context) error {
+	return app.Shutdown(ctx)
+}
+
 func Run() {
 	if EnableDaemon {
 		util.CallMethod(&util, "SetDaemonMode", 1, 0)
@@ -94,15 +188,168 @@ func LoadConfig() {
 	if v, ok := cfg.GetConfig("EnableStats").Bool(); ok {
 		EnableStats = v
 	}
+	if v, ok := cfg.GetConfig("AppMode").String(); ok {
+		AppMode = v
+	}
+	if v, ok := cfg.GetConfig("CookieSecret").String(); ok {
+		CookieSecret = v
+	}
+	if v, ok := cfg.GetConfig("CookieLegacySecrets").String(); ok {
+		CookieLegacySecrets = strings.Fields(strings.Replace(v, ",", " ", -1))
+	}
+	if v, ok := cfg.GetConfig("CookiePath").String(); ok {
+		CookiePath = v
+	}
+	if v, ok := cfg.GetConfig("CookieDomain").String(); ok {
+		CookieDomain = v
+	}
+	if v, ok := cfg.GetConfig("CookieSecure").Bool(); ok {
+		CookieSecure = v
+	}
+	if v, ok := cfg.GetConfig("CookieHttpOnly").Bool(); ok {
+		CookieHttpOnly = v
+	}
+	if v, ok := cfg.GetConfig("CookieSameSite").String(); ok {
+		CookieSameSite = v
+	}
+	if v, ok := cfg.GetConfig("FlashCookieName").String(); ok {
+		FlashCookieName = v
+	}
 	if v, ok := cfg.GetConfig("SessionName").String(); ok {
 		SessionName = v
 	}
 	if v, ok := cfg.GetConfig("SessionTTL").Int(); ok {
 		SessionTTL = int64(v)
 	}
+	if v, ok := cfg.GetConfig("SessionIdLength").Int(); ok {
+		SessionIdLength = v
+	}
+	if v, ok := cfg.GetConfig("SessionMaxEntries").Int(); ok {
+		SessionMaxEntries = v
+	}
+	if v, ok := cfg.GetConfig("SessionStorage").String(); ok {
+		SessionStorage = v
+	}
+	if v, ok := cfg.GetConfig("SessionSavePath").String(); ok {
+		SessionSavePath = v
+	}
+	if v, ok := cfg.GetConfig("SessionCookieMaxChunks").Int(); ok {
+		SessionCookieMaxChunks = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisAddr").String(); ok {
+		SessionRedisAddr = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisPassword").String(); ok {
+		SessionRedisPassword = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisDB").Int(); ok {
+		SessionRedisDB = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisPrefix").String(); ok {
+		SessionRedisPrefix = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisPoolSize").Int(); ok {
+		SessionRedisPoolSize = v
+	}
+	if v, ok := cfg.GetConfig("SessionRedisTimeout").Int(); ok {
+		SessionRedisTimeout = v
+	}
+	if v, ok := cfg.GetConfig("SessionSQLDriver").String(); ok {
+		SessionSQLDriver = v
+	}
+	if v, ok := cfg.GetConfig("SessionSQLDSN").String(); ok {
+		SessionSQLDSN = v
+	}
+	if v, ok := cfg.GetConfig("SessionSQLDialect").String(); ok {
+		SessionSQLDialect = v
+	}
+	if v, ok := cfg.GetConfig("SessionSQLTable").String(); ok {
+		SessionSQLTable = v
+	}
 	if v, ok := cfg.GetConfig("EnablePprof").Bool(); ok {
 		EnablePprof = v
 	}
+	if v, ok := cfg.GetConfig("EnableGzip").Bool(); ok {
+		EnableGzip = v
+	}
+	if v, ok := cfg.GetConfig("CompressMinSize").Int(); ok {
+		CompressMinSize = v
+	}
+	if v, ok := cfg.GetConfig("CompressLevel").Int(); ok {
+		CompressLevel = v
+	}
+	if v, ok := cfg.GetConfig("CompressTypes").String(); ok {
+		CompressTypes = strings.Fields(strings.Replace(v, ",", " ", -1))
+	}
+	if v, ok := cfg.GetConfig("MaxBodySize").Int(); ok {
+		MaxBodySize = int64(v)
+	}
+	if v, ok := cfg.GetConfig("MaxUploadSize").Int(); ok {
+		MaxUploadSize = int64(v)
+	}
+	if v, ok := cfg.GetConfig("UploadMaxMemory").Int(); ok {
+		UploadMaxMemory = int64(v)
+	}
+	if v, ok := cfg.GetConfig("ResumableUploadExpiry").Int(); ok {
+		ResumableUploadExpiry = v
+	}
+	if v, ok := cfg.GetConfig("ResumableUploadMaxSize").Int(); ok {
+		ResumableUploadMaxSize = int64(v)
+	}
+	if v, ok := cfg.GetConfig("EnableETag").Bool(); ok {
+		EnableETag = v
+	}
+	if v, ok := cfg.GetConfig("SSEHeartbeat").Int(); ok {
+		SSEHeartbeat = v
+	}
+	if v, ok := cfg.GetConfig("WebSocketMaxMessageSize").Int(); ok {
+		WebSocketMaxMessageSize = int64(v)
+	}
+	if v, ok := cfg.GetConfig("WebSocketPingInterval").Int(); ok {
+		WebSocketPingInterval = v
+	}
+	if v, ok := cfg.GetConfig("WebSocketWriteTimeout").Int(); ok {
+		WebSocketWriteTimeout = v
+	}
+	if v, ok := cfg.GetConfig("WebSocketOrigins").String(); ok {
+		WebSocketOrigins = strings.Fields(strings.Replace(v, ",", " ", -1))
+	}
+	if v, ok := cfg.GetConfig("EnableCSRF").Bool(); ok {
+		EnableCSRF = v
+	}
+	if v, ok := cfg.GetConfig("CSRFMode").String(); ok {
+		CSRFMode = v
+	}
+	if v, ok := cfg.GetConfig("CSRFTokenName").String(); ok {
+		CSRFTokenName = v
+	}
+	if v, ok := cfg.GetConfig("CSRFHeader").String(); ok {
+		CSRFHeader = v
+	}
+	if v, ok := cfg.GetConfig("CSRFCookieName").String(); ok {
+		CSRFCookieName = v
+	}
+	if v, ok := cfg.GetConfig("CSRFCheckOrigin").Bool(); ok {
+		CSRFCheckOrigin = v
+	}
+	if v, ok := cfg.GetConfig("CSRFTrustedOrigins").String(); ok {
+		CSRFTrustedOrigins = strings.Fields(strings.Replace(v, ",", " ", -1))
+	}
+	if v, ok := cfg.GetConfig("CSRFExempt").String(); ok {
+		CSRFExempt = strings.Fields(strings.Replace(v, ",", " ", -1))
+	}
+	if v, ok := cfg.GetConfig("EnablePrettyRender").Bool(); ok {
+		EnablePrettyRender = v
+	}
+	if v, ok := cfg.GetConfig("JSONPCallbackParam").String(); ok {
+		JSONPCallbackParam = v
+	}
+	if v, ok := cfg.GetConfig("EnableAssetFingerprint").Bool(); ok {
+		EnableAssetFingerprint = v
+	}
+	if v, ok := cfg.GetConfig("AssetManifest").String(); ok {
+		AssetManifest = v
+	}
 }
 
 func GetConfig(key string) *torConfigValue {
@@ -0,0 +1,237 @@
+package tor
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrRequestTooLarge = errors.New("Request body too large")
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// limitBody caps the request body to MaxUploadSize for multipart requests
+// and MaxBodySize otherwise. It returns ErrRequestTooLarge when the declared
+// Content-Length is already over the limit. Resumable upload chunks are
+// capped by ResumableUploadMaxSize instead, and by their Upload-Length in
+// the resumable controller.
+func limitBody(w http.ResponseWriter, r *http.Request, resumable bool) error {
+	limit := MaxBodySize
+	if isMultipart(r) {
+		limit = MaxUploadSize
+	}
+	if resumable {
+		limit = ResumableUploadMaxSize
+	}
+	if limit <= 0 || r.Body == nil {
+		return nil
+	}
+	if r.ContentLength > limit {
+		return ErrRequestTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return nil
+}
+
+func isTooLarge(err error) bool {
+	if err == ErrRequestTooLarge {
+		return true
+	}
+	_, ok := err.(*http.MaxBytesError)
+	return ok
+}
+
+// parseMultipart parses a multipart body on first use, so that controllers
+// streaming it with StreamUploads never buffer the files. A body over
+// MaxUploadSize aborts the request with 413.
+func (this *torContext) parseMultipart() error {
+	r := this.Request
+	if r.MultipartForm != nil || this.multipartRead || !isMultipart(r) {
+		return nil
+	}
+	this.multipartRead = true
+	err := r.ParseMultipartForm(UploadMaxMemory)
+	if isTooLarge(err) {
+		this.Abort(413, "Request Entity Too Large")
+	}
+	return err
+}
+
+// StreamUploads reads a multipart body part by part and calls handle for
+// every file, which must consume or save it before returning. Other fields
+// are added to the request form. It can not be combined with GetUploadFile.
+// If the body was parsed already, e.g. by the CSRF check reading a form
+// token, the parsed files are handed over instead; send the token in the
+// CSRFHeader header to keep streaming.
+func (this *torContext) StreamUploads(handle func(part *torUploadPart) error) error {
+	if r := this.Request; r.MultipartForm != nil {
+		return this.handleParsedUploads(handle)
+	}
+	if this.multipartRead {
+		return errors.New("Multipart body already read")
+	}
+	this.multipartRead = true
+	mr, err := this.Request.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if isTooLarge(err) {
+				this.Abort(413, "Request Entity Too Large")
+			}
+			return err
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, MaxBodySize))
+			part.Close()
+			if err != nil {
+				if isTooLarge(err) {
+					this.Abort(413, "Request Entity Too Large")
+				}
+				return err
+			}
+			this.Request.Form.Add(part.FormName(), string(value))
+			this.Request.PostForm.Add(part.FormName(), string(value))
+			continue
+		}
+		err = handle(&torUploadPart{
+			FieldName:   part.FormName(),
+			Filename:    SanitizeFilename(part.FileName()),
+			RawFilename: part.FileName(),
+			header:      part.Header,
+			reader:      part,
+		})
+		part.Close()
+		if err != nil {
+			if isTooLarge(err) {
+				this.Abort(413, "Request Entity Too Large")
+			}
+			return err
+		}
+	}
+}
+
+// handleParsedUploads calls handle for the files of a parsed multipart form.
+func (this *torContext) handleParsedUploads(handle func(part *torUploadPart) error) error {
+	for field, headers := range this.Request.MultipartForm.File {
+		for _, fh := range headers {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			err = handle(&torUploadPart{
+				FieldName:   field,
+				Filename:    SanitizeFilename(fh.Filename),
+				RawFilename: fh.Filename,
+				header:      fh.Header,
+				reader:      f,
+			})
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// torUploadPart is a file being streamed from a multipart body.
+type torUploadPart struct {
+	FieldName string
+	// Filename is safe to use as a file name, see SanitizeFilename.
+	Filename    string
+	RawFilename string
+	header      textproto.MIMEHeader
+	reader      io.Reader
+}
+
+func (this *torUploadPart) Read(p []byte) (int, error) {
+	return this.reader.Read(p)
+}
+
+func (this *torUploadPart) GetContentType() string {
+	return this.header.Get("Content-Type")
+}
+
+// SaveFile streams the part to savePath atomically.
+func (this *torUploadPart) SaveFile(savePath string) error {
+	return saveFileAtomic(this.reader, savePath)
+}
+
+// saveFileAtomic writes r to a temporary file next to savePath and renames
+// it into place, so readers never see a partial or stale file.
+func saveFileAtomic(r io.Reader, savePath string) error {
+	return writeFileAtomic(r, savePath, 0644)
+}
+
+func writeFileAtomic(r io.Reader, savePath string, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(savePath), ".upload-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, savePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// SanitizeFilename turns a client supplied file name into a safe base name:
+// directories, control and reserved characters and leading dots are removed
+// and the length is limited to 255 bytes.
+func SanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > 255 {
+		ext := filepath.Ext(name)
+		if len(ext) > 32 {
+			ext = ""
+		}
+		base := name[:255-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
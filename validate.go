@@ -0,0 +1,329 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValidatorFunc reports whether the field value passes the rule with param.
+type ValidatorFunc func(v reflect.Value, param string) bool
+
+var (
+	validators = map[string]ValidatorFunc{
+		"min":   validateMin,
+		"max":   validateMax,
+		"len":   validateLen,
+		"regex": validateRegex,
+		"email": validateEmail,
+		"oneof": validateOneOf,
+	}
+	validatorMessages = map[string]string{
+		"required": "is required",
+		"min":      "must be at least %s",
+		"max":      "must be at most %s",
+		"len":      "must have length %s",
+		"regex":    "has an invalid format",
+		"email":    "must be a valid email address",
+		"oneof":    "must be one of %s",
+		"type":     "has an invalid value",
+	}
+	emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	regexpCache = make(map[string]*regexp.Regexp)
+	regexpLock  sync.Mutex
+)
+
+// RegisterValidator adds a custom rule usable in `validate` tags as name or
+// name=param. message may contain one %s verb for the param.
+func RegisterValidator(name string, fn ValidatorFunc, message string) {
+	validators[name] = fn
+	if message != "" {
+		validatorMessages[name] = message
+	}
+}
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+func (this *ValidationError) Error() string {
+	return this.Field + " " + this.Message
+}
+
+// ValidationErrors holds the first failed rule of every invalid field, keyed
+// by the same field names Bind uses, e.g. {{with .Errors.email}} in templates.
+type ValidationErrors map[string]*ValidationError
+
+func (this ValidationErrors) Error() string {
+	fields := make([]string, 0, len(this))
+	for field := range this {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = this[field].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (this ValidationErrors) Messages() map[string]string {
+	msgs := make(map[string]string, len(this))
+	for field, err := range this {
+		msgs[field] = err.Message
+	}
+	return msgs
+}
+
+func (this ValidationErrors) add(field, rule, param string) {
+	msg, ok := validatorMessages[rule]
+	if !ok {
+		msg = "is invalid"
+	}
+	if strings.Contains(msg, "%s") {
+		msg = fmt.Sprintf(msg, param)
+	}
+	this[field] = &ValidationError{
+		Field:   field,
+		Rule:    rule,
+		Param:   param,
+		Message: msg,
+	}
+}
+
+// Validate checks the struct (or pointer to struct) v against its
+// `validate` tags. It returns ValidationErrors if any field is invalid, or
+// another error if a tag names an unknown rule or a bad regex.
+func Validate(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return errors.New("Validate value must be a struct")
+	}
+	errs := make(ValidationErrors)
+	if err := validateStruct(rv, "", errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(v reflect.Value, prefix string, errs ValidationErrors) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		if field.Anonymous && fv.Kind() == reflect.Struct {
+			if err := validateStruct(fv, prefix, errs); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		name := validateFieldName(field)
+		if name == "-" {
+			continue
+		}
+		name = prefix + name
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if err := validateField(fv, name, tag, errs); err != nil {
+				return err
+			}
+		}
+		if _, failed := errs[name]; failed {
+			continue
+		}
+		ev := reflect.Indirect(fv)
+		if ev.Kind() == reflect.Struct && ev.Type() != timeType {
+			if err := validateStruct(ev, name+".", errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateFieldName(field reflect.StructField) string {
+	if name := field.Tag.Get("form"); name != "" {
+		return name
+	}
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+func validateField(v reflect.Value, name, tag string, errs ValidationErrors) error {
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			// the pattern may contain commas, so it takes the rest of the tag
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		rule = strings.TrimSpace(rule)
+		param := ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, param = rule[:i], rule[i+1:]
+		}
+		if rule == "" {
+			continue
+		}
+		if rule == "required" {
+			if isZeroValue(v) {
+				errs.add(name, rule, param)
+				return nil
+			}
+			continue
+		}
+		fn, ok := validators[rule]
+		if !ok {
+			return errors.New("Unknown validator " + strconv.Quote(rule) + " on field " + name)
+		}
+		if rule == "regex" {
+			if _, err := compileRegex(param); err != nil {
+				return errors.New("Invalid regex on field " + name + ": " + err.Error())
+			}
+		}
+		if isZeroValue(v) {
+			// optional fields are only checked when set
+			continue
+		}
+		if !fn(reflect.Indirect(v), param) {
+			errs.add(name, rule, param)
+			return nil
+		}
+	}
+	return nil
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// validateSize compares numbers by value and strings, slices and maps by length.
+func validateSize(v reflect.Value, param string, cmp func(a, b float64) bool) bool {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return cmp(float64(len([]rune(v.String()))), limit)
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return cmp(float64(v.Len()), limit)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp(float64(v.Int()), limit)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp(float64(v.Uint()), limit)
+	case reflect.Float32, reflect.Float64:
+		return cmp(v.Float(), limit)
+	}
+	return false
+}
+
+func validateMin(v reflect.Value, param string) bool {
+	return validateSize(v, param, func(a, b float64) bool { return a >= b })
+}
+
+func validateMax(v reflect.Value, param string) bool {
+	return validateSize(v, param, func(a, b float64) bool { return a <= b })
+}
+
+func validateLen(v reflect.Value, param string) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return validateSize(v, param, func(a, b float64) bool { return a == b })
+	}
+	return false
+}
+
+func validateRegex(v reflect.Value, param string) bool {
+	if v.Kind() != reflect.String {
+		return false
+	}
+	re, err := compileRegex(param)
+	return err == nil && re.MatchString(v.String())
+}
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexpLock.Lock()
+	defer regexpLock.Unlock()
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+func validateEmail(v reflect.Value, param string) bool {
+	return v.Kind() == reflect.String && emailRegexp.MatchString(v.String())
+}
+
+func validateOneOf(v reflect.Value, param string) bool {
+	value := fmt.Sprint(v.Interface())
+	for _, option := range strings.Fields(param) {
+		if value == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Binds the request into dst like Bind and then validates it. Bind errors are
+// reported as ValidationErrors with the "type" rule.
+func (this *torContext) BindValid(dst interface{}) error {
+	if err := this.Bind(dst); err != nil {
+		bindErrs, ok := err.(BindErrors)
+		if !ok {
+			return err
+		}
+		errs := make(ValidationErrors)
+		for field := range bindErrs {
+			errs.add(field, "type", "")
+		}
+		switch e := Validate(dst).(type) {
+		case ValidationErrors:
+			for field, fe := range e {
+				if _, exist := errs[field]; !exist {
+					errs[field] = fe
+				}
+			}
+		case error:
+			return e
+		}
+		return errs
+	}
+	return Validate(dst)
+}
+
+// Aborts the request with status 422 and the validation errors as JSON body.
+func (this *torContext) AbortValidation(errs ValidationErrors) {
+	if err := this.RenderJSON(422, map[string]ValidationErrors{"errors": errs}); err != nil {
+		this.Abort(500, err.Error())
+		return
+	}
+	this.Finish()
+}
@@ -0,0 +1,437 @@
+package tor
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket message types, as defined by the RFC 6455 opcodes.
+const (
+	WebSocketContinuation  = 0
+	WebSocketTextMessage   = 1
+	WebSocketBinaryMessage = 2
+	WebSocketCloseMessage  = 8
+	WebSocketPingMessage   = 9
+	WebSocketPongMessage   = 10
+)
+
+// WebSocket close codes.
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketMaxSize caps messages even when MaxMessageSize is 0, so that a
+// frame header can not make us allocate any length the client claims.
+const websocketMaxSize = 1 << 30
+
+// WebSocketCheckOrigin decides whether an upgrade request may proceed. When
+// nil, requests without Origin, from the same host, or from one of
+// WebSocketOrigins are accepted.
+var WebSocketCheckOrigin func(r *http.Request) bool
+
+var ErrWebSocketClosed = errors.New("WebSocket closed")
+
+type WebSocketCloseError struct {
+	Code int
+	Text string
+}
+
+func (this *WebSocketCloseError) Error() string {
+	return "WebSocket closed with code " + strconv.Itoa(this.Code) + ": " + this.Text
+}
+
+func checkWebSocketOrigin(r *http.Request) bool {
+	if WebSocketCheckOrigin != nil {
+		return WebSocketCheckOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range WebSocketOrigins {
+		if strings.EqualFold(o, origin) || strings.EqualFold(o, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket switches the request to the WebSocket protocol. Call it
+// from a controller method, after AfterInit hooks had their chance to
+// authenticate the request. The session is saved and its cookies sent with
+// the upgrade; later changes can not set cookies anymore. The first of the
+// subprotocols requested by the client is selected. On failure the request
+// is aborted with 400 or 403 and an error is returned.
+func (this *torContext) UpgradeWebSocket(subprotocols ...string) (*torWebSocket, error) {
+	r := this.Request
+	if r.Method != "GET" || !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		this.Abort(400, "Bad Request")
+		return nil, errors.New("Not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		this.SetHeader("Sec-WebSocket-Version", "13")
+		this.Abort(400, "Bad Request")
+		return nil, errors.New("Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		this.Abort(400, "Bad Request")
+		return nil, errors.New("Invalid Sec-WebSocket-Key")
+	}
+	if !checkWebSocketOrigin(r) {
+		this.Abort(403, "Forbidden")
+		return nil, errors.New("WebSocket origin not allowed")
+	}
+	protocol := ""
+	for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		offered = strings.TrimSpace(offered)
+		for _, p := range subprotocols {
+			if protocol == "" && offered == p {
+				protocol = p
+			}
+		}
+	}
+
+	conn, brw, err := this.Response.Hijack()
+	if err != nil {
+		this.Abort(500, "Internal Server Error")
+		return nil, err
+	}
+	this.Finish()
+
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	//the session, CSRF and flash cookies set before the upgrade
+	for _, cookie := range this.Response.Header()["Set-Cookie"] {
+		resp += "Set-Cookie: " + cookie + "\r\n"
+	}
+	resp += "\r\n"
+	if _, err := brw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws := &torWebSocket{
+		conn:           conn,
+		reader:         brw.Reader,
+		writer:         brw.Writer,
+		Subprotocol:    protocol,
+		MaxMessageSize: WebSocketMaxMessageSize,
+		closed:         make(chan struct{}),
+	}
+	if WebSocketPingInterval > 0 {
+		go ws.keepAlive(time.Duration(WebSocketPingInterval) * time.Second)
+	}
+	return ws, nil
+}
+
+type torWebSocket struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	writer         *bufio.Writer
+	writeLock      sync.Mutex
+	closeOnce      sync.Once
+	closed         chan struct{}
+	closeSent      bool
+	Subprotocol    string
+	MaxMessageSize int64
+	// PongHandler is called with the payload of every pong received.
+	PongHandler func(data []byte)
+}
+
+func (this *torWebSocket) RemoteAddr() net.Addr {
+	return this.conn.RemoteAddr()
+}
+
+func (this *torWebSocket) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-ticker.C:
+			if this.Ping(nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (this *torWebSocket) writeFrame(opcode int, payload []byte) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	if this.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == WebSocketCloseMessage {
+		this.closeSent = true
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if WebSocketWriteTimeout > 0 {
+		this.conn.SetWriteDeadline(time.Now().Add(time.Duration(WebSocketWriteTimeout) * time.Second))
+	}
+	if _, err := this.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := this.writer.Write(payload); err != nil {
+		return err
+	}
+	return this.writer.Flush()
+}
+
+func (this *torWebSocket) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(this.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := int(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, this.fail(WebSocketCloseProtocolError, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, this.fail(WebSocketCloseProtocolError, "client frame not masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(this.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(this.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= WebSocketCloseMessage && (length > 125 || !fin) {
+		return false, 0, nil, this.fail(WebSocketCloseProtocolError, "invalid control frame")
+	}
+	if length&(1<<63) != 0 {
+		return false, 0, nil, this.fail(WebSocketCloseProtocolError, "invalid payload length")
+	}
+	if length > uint64(this.maxSize()) {
+		return false, 0, nil, this.fail(WebSocketCloseMessageTooBig, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(this.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(this.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (this *torWebSocket) maxSize() int64 {
+	if this.MaxMessageSize > 0 && this.MaxMessageSize < websocketMaxSize {
+		return this.MaxMessageSize
+	}
+	return websocketMaxSize
+}
+
+// fail closes the connection because of a protocol violation by the peer.
+func (this *torWebSocket) fail(code int, text string) error {
+	this.writeClose(code, text)
+	this.closeConn()
+	return &WebSocketCloseError{Code: code, Text: text}
+}
+
+func (this *torWebSocket) writeClose(code int, text string) error {
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return this.writeFrame(WebSocketCloseMessage, payload)
+}
+
+func (this *torWebSocket) closeConn() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.conn.Close()
+	})
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragmented messages. Pings are answered automatically. When the peer
+// closes the connection a *WebSocketCloseError is returned.
+func (this *torWebSocket) ReadMessage() (int, []byte, error) {
+	msgType := 0
+	var data []byte
+	for {
+		if WebSocketPingInterval > 0 {
+			this.conn.SetReadDeadline(time.Now().Add(2 * time.Duration(WebSocketPingInterval) * time.Second))
+		}
+		fin, opcode, payload, err := this.readFrame()
+		if err != nil {
+			this.closeConn()
+			return 0, nil, err
+		}
+		switch opcode {
+		case WebSocketPingMessage:
+			if err := this.writeFrame(WebSocketPongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WebSocketPongMessage:
+			if this.PongHandler != nil {
+				this.PongHandler(payload)
+			}
+			continue
+		case WebSocketCloseMessage:
+			closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+			if len(payload) == 1 {
+				return 0, nil, this.fail(WebSocketCloseProtocolError, "invalid close payload")
+			}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+				if !utf8.ValidString(closeErr.Text) {
+					return 0, nil, this.fail(WebSocketCloseProtocolError, "invalid close reason")
+				}
+			}
+			// echo the close frame to complete the closing handshake
+			if closeErr.Code == WebSocketCloseNoStatus {
+				this.writeFrame(WebSocketCloseMessage, nil)
+			} else {
+				this.writeClose(closeErr.Code, "")
+			}
+			this.closeConn()
+			return 0, nil, closeErr
+		case WebSocketTextMessage, WebSocketBinaryMessage:
+			if msgType != 0 {
+				return 0, nil, this.fail(WebSocketCloseProtocolError, "expected continuation frame")
+			}
+			msgType = opcode
+			data = payload
+		case WebSocketContinuation:
+			if msgType == 0 {
+				return 0, nil, this.fail(WebSocketCloseProtocolError, "unexpected continuation frame")
+			}
+			data = append(data, payload...)
+		default:
+			return 0, nil, this.fail(WebSocketCloseProtocolError, "unknown opcode")
+		}
+		if int64(len(data)) > this.maxSize() {
+			return 0, nil, this.fail(WebSocketCloseMessageTooBig, "message too big")
+		}
+		if fin {
+			if msgType == WebSocketTextMessage && !utf8.Valid(data) {
+				return 0, nil, this.fail(WebSocketCloseInvalidPayload, "invalid UTF-8")
+			}
+			return msgType, data, nil
+		}
+	}
+}
+
+func (this *torWebSocket) WriteMessage(msgType int, data []byte) error {
+	if msgType != WebSocketTextMessage && msgType != WebSocketBinaryMessage {
+		return errors.New("Invalid WebSocket message type")
+	}
+	return this.writeFrame(msgType, data)
+}
+
+func (this *torWebSocket) WriteText(text string) error {
+	return this.writeFrame(WebSocketTextMessage, []byte(text))
+}
+
+func (this *torWebSocket) Ping(data []byte) error {
+	return this.writeFrame(WebSocketPingMessage, data)
+}
+
+// Close starts the closing handshake, waits briefly for the peer to answer
+// and closes the connection.
+func (this *torWebSocket) Close(code int, text string) error {
+	err := this.writeClose(code, text)
+	if err == ErrWebSocketClosed {
+		this.closeConn()
+		return nil
+	}
+	if err == nil {
+		this.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, opcode, _, e := this.readFrame()
+			if e != nil || opcode == WebSocketCloseMessage {
+				break
+			}
+		}
+	}
+	this.closeConn()
+	return err
+}